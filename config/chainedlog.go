@@ -0,0 +1,69 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+)
+
+// ChainedLog appends entries containing hash of previous entry, so removed
+// or altered entries break the chain
+type ChainedLog struct {
+	writer   io.Writer
+	prevHash string
+	mx       sync.Mutex
+}
+
+// NewChainedLog creates ChainedLog continuing chain of lastEntry, chain
+// starts with empty hash if lastEntry is empty
+func NewChainedLog(writer io.Writer, lastEntry string) *ChainedLog {
+	cl := &ChainedLog{writer: writer}
+	if lastEntry != "" {
+		cl.prevHash = EntryHash(lastEntry)
+	}
+	return cl
+}
+
+// openChainedLog opens ChainedLog file, chain continues last entry of file
+func openChainedLog(path string) (*ChainedLog, error) {
+	lastEntry, err := lastLine(path)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := newRotatingWriter(path, 0, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	return NewChainedLog(writer, lastEntry), nil
+}
+
+// EntryHash returns hash of entry referenced by next entry
+func EntryHash(entry string) string {
+	sum := sha256.Sum256([]byte(entry))
+	return hex.EncodeToString(sum[:])
+}
+
+// Append writes entry built by mkEntry from hash of previous entry. Entries
+// must be single lines
+func (cl *ChainedLog) Append(mkEntry func(prevHash string) ([]byte, error)) error {
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	entry, err := mkEntry(cl.prevHash)
+	if err != nil {
+		return err
+	}
+	if _, err = cl.writer.Write(append(entry, '\n')); err != nil {
+		return err
+	}
+	cl.prevHash = EntryHash(string(entry))
+	return nil
+}
+
+// Close closes underlying writer if it's io.Closer
+func (cl *ChainedLog) Close() error {
+	if closer, ok := cl.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
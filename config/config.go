@@ -6,8 +6,12 @@ import (
 	"io/ioutil"
 	"log"
 	"log/syslog"
+	"net"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	set "github.com/deckarep/golang-set"
 	"github.com/go-yaml/yaml"
@@ -17,11 +21,46 @@ import (
 type YamlConfig struct {
 	// Listen interface and port e.g. "0:8000", "localhost:9090", ":80"
 	Listen string `yaml:"Listen,omitempty"`
+	// Listen interface and port of administrative endpoints e.g. "localhost:8081",
+	// disabled if empty
+	AdminListen string `yaml:"AdminListen,omitempty"`
 	// List of backend uri's e.g. "http:// s3.mydaracenter.org"
 	Backends []YAMLURL `yaml:"Backends,omitempty,flow"`
+	// Fail if any backend is listed more than once in Backends, otherwise
+	// only warning is logged
+	RejectDuplicateBackends bool `yaml:"RejectDuplicateBackends,omitempty"`
+	// Read weights of backends keyed by backend host e.g. "127.0.0.1:9001".
+	// If set and ReplicatedMethods are not, GET and HEAD requests are not
+	// replicated. Backends not listed have weight 1
+	BackendWeights map[string]int `yaml:"BackendWeights,omitempty"`
+	// Methods of requests replicated to all backends. Bodiless requests with
+	// other methods are sent to backends one at a time, in random order
+	// according to BackendWeights, until one succeeds. All requests are
+	// replicated if empty
+	ReplicatedMethods []string `yaml:"ReplicatedMethods,omitempty"`
 	// Limit of outgoing connections. When limit is reached, akubra will omit external backend
 	// with greatest number of stalled connections
 	ConnLimit int64 `yaml:"ConnLimit,omitempty"`
+	// Host header sent to backends keyed by backend host, e.g. for backends
+	// behind shared load balancer. Other backends receive their own host
+	BackendHostHeaders map[string]string `yaml:"BackendHostHeaders,omitempty"`
+	// Credentials requests to backends are signed with instead of client
+	// signature, keyed by backend host. Other backends receive client signature
+	BackendCredentials map[string]BackendCredentialsConfig `yaml:"BackendCredentials,omitempty"`
+	// Client signatures are not verified, so any signed request gets
+	// privileges of BackendCredentials. They are accepted only if clients are
+	// declared trusted
+	BackendCredentialsTrustedClients bool `yaml:"BackendCredentialsTrustedClients,omitempty"`
+	// Limit of in flight requests per backend, disabled if 0. Slow backend
+	// can't take connections other backends need
+	PerBackendConnLimit int `yaml:"PerBackendConnLimit,omitempty"`
+	// How long requests wait for free slot once PerBackendConnLimit is reached
+	// e.g. "100ms", requests to busy backend fail immediately if empty
+	PerBackendQueueTimeout string `yaml:"PerBackendQueueTimeout,omitempty"`
+	// Limit of idle (keep-alive) connections per backend, defaults to ConnLimit
+	MaxIdleConnsPerHost int `yaml:"MaxIdleConnsPerHost,omitempty"`
+	// Limit of idle (keep-alive) connections to all backends, 0 means no limit
+	MaxIdleConns int `yaml:"MaxIdleConns,omitempty"`
 	// Additional not amazon specific headers proxy will add to original request
 	AdditionalRequestHeaders map[string]string `yaml:"AdditionalRequestHeaders,omitempty"`
 	// Additional headers added to backend response
@@ -30,12 +69,183 @@ type YamlConfig struct {
 	ConnectionTimeout string `yaml:"ConnectionTimeout,omitempty"`
 	// Dial timeout on outgoing connections
 	ConnectionDialTimeout string `yaml:"ConnectionDialTimeout,omitempty"`
+	// Time allowed for client to send request headers, connection is closed
+	// after that. Protects from slow-loris attacks
+	ReadHeaderTimeout string `yaml:"ReadHeaderTimeout,omitempty"`
 	// Backend in maintenance mode. Akubra will not send data there
 	MaintainedBackend string `yaml:"MaintainedBackend,omitempty"`
 	// List request methods to be logged in synclog in case of backend failure
 	SyncLogMethods []string `yaml:"SyncLogMethods,omitempty"`
+	// Write synclog to file instead of syslog
+	SyncLogFile string `yaml:"SyncLogFile,omitempty"`
+	// Compress synclog file with gzip
+	SyncLogCompress bool `yaml:"SyncLogCompress,omitempty"`
+	// Rotate synclog file after given number of (uncompressed) bytes, 0 disables rotation
+	SyncLogMaxSize int64 `yaml:"SyncLogMaxSize,omitempty"`
+	// Number of rotated synclog files kept, older ones are removed. 0 keeps all
+	SyncLogMaxFiles int `yaml:"SyncLogMaxFiles,omitempty"`
+	// Write audit record of every DELETE and DeleteObjects request to given
+	// file, disabled if empty
+	DeleteAuditLogFile string `yaml:"DeleteAuditLogFile,omitempty"`
+	// GET requests with path starting with any of listed prefixes are served
+	// only after comparing content returned by all backends. Backends which
+	// returned content different than majority are logged in synclog
+	VerifiedReadPrefixes []string `yaml:"VerifiedReadPrefixes,omitempty"`
+	// Objects longer than given number of bytes are not verified, first
+	// successful response is passed instead. Defaults to 16 MiB
+	VerifiedReadMaxBytes int64 `yaml:"VerifiedReadMaxBytes,omitempty"`
+	// Treat GET responses with 200 status and empty body as failed, so non empty
+	// response from other backend is passed to client
+	EmptyReadsAsFailures bool `yaml:"EmptyReadsAsFailures,omitempty"`
+	// Compare x-amz-checksum-* headers returned by backends, mismatches are
+	// logged in synclog
+	VerifyChecksumHeaders bool `yaml:"VerifyChecksumHeaders,omitempty"`
+	// Host of backend which response is returned for writes (requests other
+	// than GET, HEAD and OPTIONS) if it succeeded, so response headers like
+	// ETag come from same backend. Other backends response is returned only
+	// if it failed
+	WriteResponseBackend string `yaml:"WriteResponseBackend,omitempty"`
+	// Status classes (e.g. 4 for 4xx) of failed backend responses in order of
+	// preference, used to pick response passed if all backends failed.
+	// Response with lowest status is passed among unlisted classes
+	ResponseStatusPreference []int `yaml:"ResponseStatusPreference,omitempty"`
+	// Request gzip encoded responses from backends for GET requests of clients
+	// not accepting gzip, successful responses are decompressed for them
+	RequestGzipFromBackends bool `yaml:"RequestGzipFromBackends,omitempty"`
+	// Log backends which Date response header differs from local time more
+	// than given duration e.g. "30s", disabled if empty
+	ClockSkewThreshold string `yaml:"ClockSkewThreshold,omitempty"`
+	// Headers successful backend responses must contain, keyed by request
+	// method. Responses lacking them are treated as failed
+	RequiredResponseHeaders map[string][]string `yaml:"RequiredResponseHeaders,omitempty"`
+	// Compare ETags of write responses with MD5 of request body. Backends
+	// which returned different ETag are logged in synclog. ETags of multipart
+	// uploads and objects encrypted with SSE-KMS or SSE-C are not compared
+	VerifyETags bool `yaml:"VerifyETags,omitempty"`
+	// Compare MD5 of request body with Content-MD5 header while body is
+	// streamed. Requests with mismatching body are rejected with 400 status
+	// before backends receive whole body
+	VerifyContentMD5 bool `yaml:"VerifyContentMD5,omitempty"`
+	// How long shutdown waits for writes to be replicated to all backends
+	// e.g. "30s", defaults to 10s
+	WritesDrainTimeout string `yaml:"WritesDrainTimeout,omitempty"`
 	// Should we keep alive connections with backend servers
 	KeepAlive bool `yaml:"KeepAlive"`
+	// Backends health checking, ejected backends don't receive requests
+	HealthCheck HealthCheckConfig `yaml:"HealthCheck,omitempty"`
+	// Per backend circuit breaker, disabled if FailureThreshold is 0
+	CircuitBreaker CircuitBreakerConfig `yaml:"CircuitBreaker,omitempty"`
+	// Retries of backend requests without body failed due to transient errors
+	Retry RetryConfig `yaml:"Retry,omitempty"`
+	// Upstream proxy all backend requests will be routed through e.g. "http://proxy.local:3128".
+	// Connections are made to proxy, so it can't be combined with MaintainedBackend
+	BackendProxy YAMLURL `yaml:"BackendProxy,omitempty"`
+	// Client certificate and CA bundle used for https backends
+	BackendTLS BackendTLSConfig `yaml:"BackendTLS,omitempty"`
+	// Requests with any of listed query parameters are rejected with 501 status
+	UnsupportedQueryParams []string `yaml:"UnsupportedQueryParams,omitempty"`
+	// Respond to OPTIONS requests with list of allowed methods without contacting
+	// backends. Applies only if no CORS headers are set in AdditionalResponseHeaders
+	LocalOptionsResponse bool `yaml:"LocalOptionsResponse,omitempty"`
+	// Access log verbosity level ("quiet", "normal" or "verbose") per client
+	// AWS access key or ip address. Other clients are logged with "normal" level
+	AccessLogVerbosity map[string]string `yaml:"AccessLogVerbosity,omitempty"`
+	// Access log format, "json" (default) or "text"
+	AccessLogFormat string `yaml:"AccessLogFormat,omitempty"`
+	// Number of backends which have to succeed write before it is
+	// acknowledged to client, e.g. "2" or "majority". Disabled if empty
+	WriteQuorum string `yaml:"WriteQuorum,omitempty"`
+	// Add X-Akubra-Backend header with host of backend which response was
+	// returned to responses
+	DebugBackendHeader bool `yaml:"DebugBackendHeader,omitempty"`
+	// Per client limit of transferred bytes, disabled if Bytes is 0
+	BandwidthQuota BandwidthQuotaConfig `yaml:"BandwidthQuota,omitempty"`
+	// Requests of client which received 503 SlowDown response are rejected
+	// with SlowDown error for given duration e.g. "1s", disabled if empty
+	SlowDownCooldown string `yaml:"SlowDownCooldown,omitempty"`
+	// Rejects new requests with 503 status when akubra is overloaded, disabled
+	// if SoftLimit is 0
+	AdmissionControl AdmissionControlConfig `yaml:"AdmissionControl,omitempty"`
+	// Limits size of backend response header values, disabled if MaxValueBytes is 0
+	ResponseHeaderLimit ResponseHeaderLimitConfig `yaml:"ResponseHeaderLimit,omitempty"`
+}
+
+// BackendCredentialsConfig defines AWS Signature Version 4 credentials of backend
+type BackendCredentialsConfig struct {
+	AccessKey string `yaml:"AccessKey"`
+	SecretKey string `yaml:"SecretKey"`
+	Region    string `yaml:"Region"`
+}
+
+// HealthCheckConfig defines how backends are probed
+type HealthCheckConfig struct {
+	// Path requested with GET on each backend, e.g. "/status"
+	Path string `yaml:"Path,omitempty"`
+	// Probing interval e.g. "5s", health checking is disabled if empty
+	Interval string `yaml:"Interval,omitempty"`
+	// Number of consecutive failed probes (error or 5xx status) after which
+	// backend is ejected
+	FailureThreshold int `yaml:"FailureThreshold,omitempty"`
+	// Writes are rejected with 503 status while fewer backends are healthy,
+	// reads are still served. Disabled if 0
+	MinHealthyForWrites int `yaml:"MinHealthyForWrites,omitempty"`
+}
+
+// CircuitBreakerConfig defines when backend circuit opens and closes
+type CircuitBreakerConfig struct {
+	// Number of consecutive failures (error or 5xx status) opening circuit
+	FailureThreshold int `yaml:"FailureThreshold,omitempty"`
+	// How long backend with open circuit doesn't receive requests e.g. "30s"
+	Cooldown string `yaml:"Cooldown,omitempty"`
+	// Number of successful requests needed to close half-open circuit
+	HalfOpenProbes int `yaml:"HalfOpenProbes,omitempty"`
+}
+
+// RetryConfig defines how backend requests failed due to transient errors
+// are retried
+type RetryConfig struct {
+	// Maximal number of retries per backend request, 0 disables retries
+	Count int `yaml:"Count,omitempty"`
+	// Delay before first retry e.g. "50ms", doubled on each next retry
+	Backoff string `yaml:"Backoff,omitempty"`
+	// Retried error classes: "dial", "timeout", "reset". Non idempotent
+	// requests (e.g. POST) are retried only after "dial" errors
+	Errors []string `yaml:"Errors,omitempty"`
+	// Requests with body up to MaxBodyBytes long are buffered in memory so
+	// they can be retried, requests with body are not retried if 0
+	MaxBodyBytes int64 `yaml:"MaxBodyBytes,omitempty"`
+	// Fraction of backend requests which may be retried, e.g. 0.1 allows
+	// one retry per ten requests. Defaults to 0.1
+	BudgetRatio float64 `yaml:"BudgetRatio,omitempty"`
+}
+
+// ResponseHeaderLimitConfig defines how oversized backend response headers
+// are handled
+type ResponseHeaderLimitConfig struct {
+	// Maximal size of single header value in bytes
+	MaxValueBytes int `yaml:"MaxValueBytes,omitempty"`
+	// Truncate oversized values instead of responding with 502 Bad Gateway
+	Truncate bool `yaml:"Truncate,omitempty"`
+}
+
+// AdmissionControlConfig defines load shedding thresholds
+type AdmissionControlConfig struct {
+	// Number of in flight requests above which part of new requests is rejected
+	SoftLimit int64 `yaml:"SoftLimit,omitempty"`
+	// Number of in flight requests above which all new requests are rejected
+	HardLimit int64 `yaml:"HardLimit,omitempty"`
+}
+
+// BandwidthQuotaConfig defines how many bytes (sent and received) a client
+// may transfer within time window
+type BandwidthQuotaConfig struct {
+	// Bytes allowed per client within Window
+	Bytes int64 `yaml:"Bytes,omitempty"`
+	// Accounting window duration e.g. "1m", required if Bytes is set
+	Window string `yaml:"Window,omitempty"`
+	// Throttle delays requests until window resets instead of rejecting them
+	// with 429 Too Many Requests
+	Throttle bool `yaml:"Throttle,omitempty"`
 }
 
 // Config contains processed YamlConfig data
@@ -45,6 +255,10 @@ type Config struct {
 	Synclog           *log.Logger
 	Accesslog         *log.Logger
 	Mainlog           *log.Logger
+	// DeleteAuditLog is nil if DeleteAuditLogFile is not set
+	DeleteAuditLog *ChainedLog
+	// synclog file writer, nil if synclog is written to syslog
+	syncLogWriter *rotatingWriter
 }
 
 // YAMLURL type fields in yaml configuration will parse urls
@@ -59,11 +273,17 @@ func (j *YAMLURL) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 	url, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("malformed url %q: %s", s, err)
+	}
 	if url.Host == "" {
 		return fmt.Errorf("url should match proto:// host[:port]/path scheme, got %q", s)
 	}
+	if url.Scheme != "http" && url.Scheme != "https" {
+		return fmt.Errorf("url scheme should be http or https, got %q", s)
+	}
 	j.URL = url
-	return err
+	return nil
 }
 
 // Parse json config
@@ -78,36 +298,314 @@ func parseConf(file io.Reader) (YamlConfig, error) {
 	return rc, err
 }
 
-func setupLoggers(conf *Config) error {
-	accesslog, slErr := syslog.NewLogger(syslog.LOG_LOCAL0, 0)
-	conf.Accesslog = accesslog
-	conf.Accesslog.SetPrefix("")
-	if slErr != nil {
-		return slErr
+// setupLoggers opens loggers of conf. Loggers of previous configuration
+// are reused if their settings didn't change, so files are not opened twice
+func setupLoggers(conf *Config, previous *Config) error {
+	if previous != nil && previous.Accesslog != nil && previous.Mainlog != nil {
+		conf.Accesslog = previous.Accesslog
+		conf.Mainlog = previous.Mainlog
+	} else {
+		accesslog, slErr := syslog.NewLogger(syslog.LOG_LOCAL0, 0)
+		if slErr != nil {
+			return slErr
+		}
+		conf.Accesslog = accesslog
+		conf.Accesslog.SetPrefix("")
+		conf.Mainlog, slErr = syslog.NewLogger(syslog.LOG_LOCAL2, log.LstdFlags)
+		if slErr != nil {
+			return slErr
+		}
+		conf.Mainlog.SetPrefix("main")
+	}
+	switch {
+	case previous != nil && previous.Synclog != nil && previous.SyncLogFile == conf.SyncLogFile &&
+		previous.SyncLogCompress == conf.SyncLogCompress && previous.SyncLogMaxSize == conf.SyncLogMaxSize &&
+		previous.SyncLogMaxFiles == conf.SyncLogMaxFiles:
+		conf.Synclog = previous.Synclog
+		conf.syncLogWriter = previous.syncLogWriter
+	case conf.SyncLogFile != "":
+		writer, err := newRotatingWriter(conf.SyncLogFile, conf.SyncLogMaxSize, conf.SyncLogMaxFiles, conf.SyncLogCompress)
+		if err != nil {
+			return err
+		}
+		conf.Synclog = log.New(writer, "", 0)
+		conf.syncLogWriter = writer
+	default:
+		synclog, slErr := syslog.NewLogger(syslog.LOG_LOCAL1, 0)
+		if slErr != nil {
+			return slErr
+		}
+		conf.Synclog = synclog
+		conf.Synclog.SetPrefix("")
+	}
+	switch {
+	case conf.DeleteAuditLogFile == "":
+	case previous != nil && previous.DeleteAuditLog != nil && previous.DeleteAuditLogFile == conf.DeleteAuditLogFile:
+		conf.DeleteAuditLog = previous.DeleteAuditLog
+	default:
+		auditLog, err := openChainedLog(conf.DeleteAuditLogFile)
+		if err != nil {
+			return err
+		}
+		conf.DeleteAuditLog = auditLog
+	}
+	return nil
+}
+
+// CloseUnusedLogs closes log files of c which next configuration doesn't
+// use. It should be called once nothing writes to them, pass empty Config
+// to close all of them
+func (c Config) CloseUnusedLogs(next Config) error {
+	var err error
+	if c.syncLogWriter != nil && c.syncLogWriter != next.syncLogWriter {
+		err = c.syncLogWriter.Close()
+	}
+	if c.DeleteAuditLog != nil && c.DeleteAuditLog != next.DeleteAuditLog {
+		if closeErr := c.DeleteAuditLog.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// minClientConcurrency is number of concurrent client requests below which
+// ConnLimit is considered starving
+const minClientConcurrency = 10
+
+// EffectiveConnLimits returns number of concurrent connections per backend
+// and number of concurrent client requests ConnLimit allows. Each client
+// request is replicated to all Backends, so it takes one connection per backend
+func (c Config) EffectiveConnLimits() (perBackend, clientRequests int64) {
+	if len(c.Backends) == 0 {
+		return c.ConnLimit, c.ConnLimit
+	}
+	perRequest := int64(len(c.Backends))
+	return c.ConnLimit / perRequest, c.ConnLimit / perRequest
+}
+
+// ConnLimitWarnings returns warnings if ConnLimit starves client requests
+// given their fan-out to all Backends
+func (c Config) ConnLimitWarnings() []string {
+	warnings := []string{}
+	_, clientRequests := c.EffectiveConnLimits()
+	switch {
+	case clientRequests == 0:
+		warnings = append(warnings, fmt.Sprintf(
+			"ConnLimit %d is lower than number of backends %d, requests can't be replicated to all of them",
+			c.ConnLimit, len(c.Backends)))
+	case clientRequests < minClientConcurrency:
+		warnings = append(warnings, fmt.Sprintf(
+			"ConnLimit %d allows only %d concurrent client requests replicated to %d backends",
+			c.ConnLimit, clientRequests, len(c.Backends)))
+	}
+	return warnings
+}
+
+// DuplicateBackends returns backends listed more than once in Backends,
+// requests are replicated to such backends multiple times. Backends are
+// compared by host name and port
+func (c Config) DuplicateBackends() []string {
+	duplicates := []string{}
+	seen := make(map[string]int, len(c.Backends))
+	for _, backend := range c.Backends {
+		if backend.URL == nil {
+			continue
+		}
+		key := backendAddress(backend.URL)
+		seen[key]++
+		if seen[key] == 2 {
+			duplicates = append(duplicates, key)
+		}
+	}
+	return duplicates
+}
+
+// WriteQuorumSize returns number of backends which have to succeed write
+// before it is acknowledged, 0 if WriteQuorum is not set
+func (c Config) WriteQuorumSize() (int, error) {
+	switch c.WriteQuorum {
+	case "":
+		return 0, nil
+	case "majority":
+		return len(c.Backends)/2 + 1, nil
+	}
+	quorum, err := strconv.Atoi(c.WriteQuorum)
+	if err != nil || quorum < 1 {
+		return 0, fmt.Errorf("WriteQuorum should be \"majority\" or positive number, got %q", c.WriteQuorum)
+	}
+	if quorum > len(c.Backends) {
+		return 0, fmt.Errorf("WriteQuorum %d is greater than number of backends (%d)", quorum, len(c.Backends))
+	}
+	return quorum, nil
+}
+
+// backendAddress returns lowercased host name with port, default port is
+// added if not given
+func backendAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
 	}
-	conf.Synclog, slErr = syslog.NewLogger(syslog.LOG_LOCAL1, 0)
-	conf.Synclog.SetPrefix("")
-	if slErr != nil {
-		return slErr
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// Validate checks configuration consistency, returned error lists all
+// found problems
+func (c Config) Validate() error {
+	problems := []string{}
+	if len(c.Backends) == 0 {
+		problems = append(problems, "no Backends defined")
+	}
+	hosts := make(map[string]bool, len(c.Backends))
+	for i, backend := range c.Backends {
+		if backend.URL == nil {
+			problems = append(problems, fmt.Sprintf("Backends item %d is empty", i))
+			continue
+		}
+		hosts[backend.Host] = true
+	}
+
+	if c.RejectDuplicateBackends {
+		for _, duplicate := range c.DuplicateBackends() {
+			problems = append(problems, fmt.Sprintf("backend %q is listed more than once", duplicate))
+		}
 	}
-	conf.Mainlog, slErr = syslog.NewLogger(syslog.LOG_LOCAL2, log.LstdFlags)
-	conf.Mainlog.SetPrefix("main")
 
-	return slErr
+	weightsSum := 0
+	for host, weight := range c.BackendWeights {
+		if !hosts[host] {
+			problems = append(problems, fmt.Sprintf("BackendWeights refers to unknown backend %q", host))
+		}
+		if weight < 0 {
+			problems = append(problems, fmt.Sprintf("BackendWeights of %q is negative", host))
+			continue
+		}
+		weightsSum += weight
+	}
+	if len(c.BackendWeights) > 0 && len(c.BackendWeights) == len(hosts) && weightsSum == 0 {
+		problems = append(problems, "BackendWeights of all backends are 0")
+	}
+	for host := range c.BackendHostHeaders {
+		if !hosts[host] {
+			problems = append(problems, fmt.Sprintf("BackendHostHeaders refers to unknown backend %q", host))
+		}
+	}
+	if len(c.BackendCredentials) > 0 && !c.BackendCredentialsTrustedClients {
+		problems = append(problems, "BackendCredentials require BackendCredentialsTrustedClients, "+
+			"client signatures are not verified")
+	}
+	for host, credentials := range c.BackendCredentials {
+		if !hosts[host] {
+			problems = append(problems, fmt.Sprintf("BackendCredentials refers to unknown backend %q", host))
+		}
+		if credentials.AccessKey == "" || credentials.SecretKey == "" || credentials.Region == "" {
+			problems = append(problems, fmt.Sprintf("BackendCredentials of %q require AccessKey, SecretKey and Region", host))
+		}
+	}
+	for _, class := range c.ResponseStatusPreference {
+		if class < 1 || class > 5 {
+			problems = append(problems, fmt.Sprintf("ResponseStatusPreference contains invalid status class %d", class))
+		}
+	}
+	if c.BackendProxy.URL != nil && c.MaintainedBackend != "" {
+		problems = append(problems, "MaintainedBackend can't be used with BackendProxy, "+
+			"connections are made to proxy")
+	}
+	if c.WriteResponseBackend != "" && !hosts[c.WriteResponseBackend] {
+		problems = append(problems, fmt.Sprintf("WriteResponseBackend refers to unknown backend %q", c.WriteResponseBackend))
+	}
+	if _, err := c.BackendTLS.TLSConfig(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := c.WriteQuorumSize(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.AccessLogFormat != "" && c.AccessLogFormat != "json" && c.AccessLogFormat != "text" {
+		problems = append(problems, fmt.Sprintf("AccessLogFormat should be \"json\" or \"text\", got %q", c.AccessLogFormat))
+	}
+	if c.HealthCheck.MinHealthyForWrites > 0 && c.HealthCheck.Interval == "" {
+		problems = append(problems, "HealthCheck.MinHealthyForWrites requires HealthCheck.Interval")
+	}
+	if c.HealthCheck.MinHealthyForWrites > len(c.Backends) {
+		problems = append(problems, fmt.Sprintf("HealthCheck.MinHealthyForWrites is greater than number of backends (%d)", len(c.Backends)))
+	}
+
+	durations := []struct {
+		name  string
+		value string
+	}{
+		{"ConnectionTimeout", c.ConnectionTimeout},
+		{"ConnectionDialTimeout", c.ConnectionDialTimeout},
+		{"ReadHeaderTimeout", c.ReadHeaderTimeout},
+		{"ClockSkewThreshold", c.ClockSkewThreshold},
+		{"PerBackendQueueTimeout", c.PerBackendQueueTimeout},
+		{"HealthCheck.Interval", c.HealthCheck.Interval},
+		{"CircuitBreaker.Cooldown", c.CircuitBreaker.Cooldown},
+		{"Retry.Backoff", c.Retry.Backoff},
+		{"BandwidthQuota.Window", c.BandwidthQuota.Window},
+		{"SlowDownCooldown", c.SlowDownCooldown},
+		{"WritesDrainTimeout", c.WritesDrainTimeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d.value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", d.name, err))
+		}
+	}
+	if c.Retry.BudgetRatio < 0 {
+		problems = append(problems, "Retry.BudgetRatio is negative")
+	}
+	if interval, err := time.ParseDuration(c.HealthCheck.Interval); err == nil && interval <= 0 {
+		problems = append(problems, "HealthCheck.Interval must be positive")
+	}
+	if c.BandwidthQuota.Bytes > 0 {
+		if window, err := time.ParseDuration(c.BandwidthQuota.Window); err == nil && window <= 0 ||
+			c.BandwidthQuota.Window == "" {
+			problems = append(problems, "BandwidthQuota.Bytes requires positive BandwidthQuota.Window")
+		}
+	}
+
+	if c.AdmissionControl.HardLimit > 0 && c.AdmissionControl.HardLimit < c.AdmissionControl.SoftLimit {
+		problems = append(problems, "AdmissionControl.HardLimit is lower than SoftLimit")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
 }
 
 // Configure parse configuration file
 func Configure(configFilePath string) (conf Config, err error) {
+	return configure(configFilePath, nil)
+}
+
+// Reconfigure parses configuration file like Configure, reusing loggers of
+// previous configuration which settings didn't change
+func Reconfigure(configFilePath string, previous Config) (conf Config, err error) {
+	return configure(configFilePath, &previous)
+}
+
+func configure(configFilePath string, previous *Config) (conf Config, err error) {
 	confFile, err := os.Open(configFilePath)
 	if err != nil {
 		return
 	}
+	defer func() { _ = confFile.Close() }()
 
 	yconf, err := parseConf(confFile)
 	if err != nil {
 		return
 	}
 	conf.YamlConfig = yconf
+	if err = conf.Validate(); err != nil {
+		return
+	}
 
 	if len(conf.SyncLogMethods) > 0 {
 		conf.SyncLogMethodsSet = set.NewThreadUnsafeSet()
@@ -119,6 +617,6 @@ func Configure(configFilePath string) (conf Config, err error) {
 			[]interface{}{"PUT", "GET", "HEAD", "DELETE", "OPTIONS"})
 	}
 
-	err = setupLoggers(&conf)
+	err = setupLoggers(&conf, previous)
 	return
 }
@@ -1,7 +1,16 @@
 package config
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-yaml/yaml"
 	"github.com/stretchr/testify/assert"
@@ -32,3 +41,458 @@ func TestYAMLURLParsingEmpty(t *testing.T) {
 	assert.NoError(t, err, "Should not even try to parse")
 	assert.Nil(t, testyaml.Field.URL, "Should be nil")
 }
+
+func TestYAMLURLParsingUnsupportedScheme(t *testing.T) {
+	incorrect := []byte(`field: ftp://golang.org:80/pkg/net`)
+	testyaml := TestYaml{}
+	err := yaml.Unmarshal(incorrect, &testyaml)
+	if assert.Error(t, err, "Only http and https schemes should be accepted") {
+		assert.Contains(t, err.Error(), "ftp://golang.org:80/pkg/net")
+	}
+}
+
+func TestYAMLURLParsingMalformed(t *testing.T) {
+	incorrect := []byte(`field: "http://[::1/pkg/net"`)
+	testyaml := TestYaml{}
+	err := yaml.Unmarshal(incorrect, &testyaml)
+	if assert.Error(t, err, "Malformed url should return error") {
+		assert.Contains(t, err.Error(), "http://[::1/pkg/net")
+	}
+}
+
+func readSyncLogLines(t *testing.T, path string) []string {
+	reader, err := OpenSyncLog(path)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer func() {
+		assert.NoError(t, reader.Close())
+	}()
+	content, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func TestCompressedSyncLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "synclog")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+	path := filepath.Join(dir, "sync.log.gz")
+	entry := `{"method":"PUT","failedhost":"s3.dc2.internal","path":"/bucket/key"}`
+
+	writer, err := newRotatingWriter(path, int64(2*len(entry)+2), 0, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	writer.flushInterval = time.Millisecond
+	logger := log.New(writer, "", 0)
+	for i := 0; i < 3; i++ {
+		logger.Println(entry)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	reader, err := OpenSyncLog(path)
+	if assert.NoError(t, err) {
+		content, readErr := ioutil.ReadAll(reader)
+		assert.Equal(t, io.ErrUnexpectedEOF, readErr, "Unterminated file should not look complete")
+		assert.Equal(t, entry+"\n", string(content), "Current file should be readable while written")
+		assert.NoError(t, reader.Close())
+	}
+	rotated, err := filepath.Glob(path + ".*")
+	assert.NoError(t, err)
+	if assert.Len(t, rotated, 1) {
+		assert.Equal(t, []string{entry, entry}, readSyncLogLines(t, rotated[0]))
+	}
+	assert.NoError(t, writer.Close())
+	assert.Equal(t, []string{entry}, readSyncLogLines(t, path))
+}
+
+func TestCompressedSyncLogStartsNewFileAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "synclog")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+	path := filepath.Join(dir, "sync.log.gz")
+
+	crashed, err := newRotatingWriter(path, 0, 0, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	crashed.flushInterval = time.Millisecond
+	// writer is abandoned without closing, as after crash
+	log.New(crashed, "", 0).Println("before")
+	time.Sleep(50 * time.Millisecond)
+	restarted, err := newRotatingWriter(path, 0, 0, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	log.New(restarted, "", 0).Println("after")
+	assert.NoError(t, restarted.Close())
+
+	assert.Equal(t, []string{"after"}, readSyncLogLines(t, path))
+	previous, err := filepath.Glob(path + ".*")
+	assert.NoError(t, err)
+	if assert.Len(t, previous, 1) {
+		reader, err := OpenSyncLog(previous[0])
+		if assert.NoError(t, err) {
+			content, readErr := ioutil.ReadAll(reader)
+			assert.Equal(t, io.ErrUnexpectedEOF, readErr)
+			assert.Equal(t, "before\n", string(content))
+			assert.NoError(t, reader.Close())
+		}
+	}
+}
+
+func TestSyncLogSizeIncludesDataWrittenBeforeReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "synclog")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+	path := filepath.Join(dir, "sync.log")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("previous\n"), 0644))
+
+	writer, err := newRotatingWriter(path, 12, 0, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	log.New(writer, "", 0).Println("next")
+	assert.NoError(t, writer.Close())
+
+	rotated, err := filepath.Glob(path + ".*")
+	assert.NoError(t, err)
+	if assert.Len(t, rotated, 1) {
+		assert.Equal(t, []string{"previous", "next"}, readSyncLogLines(t, rotated[0]))
+	}
+}
+
+func TestCompressedSyncLogIsFlushedPeriodically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "synclog")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+	path := filepath.Join(dir, "sync.log.gz")
+	writer, err := newRotatingWriter(path, 0, 0, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	writer.flushInterval = 50 * time.Millisecond
+	defer func() {
+		assert.NoError(t, writer.Close())
+	}()
+	logger := log.New(writer, "", 0)
+	logger.Println("first")
+	logger.Println("second")
+
+	assert.Empty(t, readSyncLogContent(t, path), "Entries should not be flushed one by one")
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, "first\nsecond\n", readSyncLogContent(t, path))
+}
+
+// readSyncLogContent returns entries readable from file which is still written
+func readSyncLogContent(t *testing.T, path string) string {
+	reader, err := OpenSyncLog(path)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer func() {
+		assert.NoError(t, reader.Close())
+	}()
+	content, _ := ioutil.ReadAll(reader)
+	return string(content)
+}
+
+func TestSyncLogKeepsMaxFilesRotatedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "synclog")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+	path := filepath.Join(dir, "sync.log")
+	other := filepath.Join(dir, "sync.log.backup")
+	assert.NoError(t, ioutil.WriteFile(other, []byte("not rotated\n"), 0644))
+
+	writer, err := newRotatingWriter(path, 1, 2, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	logger := log.New(writer, "", 0)
+	for _, entry := range []string{"first", "second", "third", "fourth"} {
+		logger.Println(entry)
+	}
+	assert.NoError(t, writer.Close())
+
+	rotated, err := filepath.Glob(path + ".2*")
+	assert.NoError(t, err)
+	if assert.Len(t, rotated, 2) {
+		assert.Equal(t, []string{"third"}, readSyncLogLines(t, rotated[0]))
+		assert.Equal(t, []string{"fourth"}, readSyncLogLines(t, rotated[1]))
+	}
+	_, err = os.Stat(other)
+	assert.NoError(t, err, "Files not created by rotation should be kept")
+}
+
+func TestPlainSyncLog(t *testing.T) {
+	file, err := ioutil.TempFile("", "synclog")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, os.Remove(file.Name()))
+	}()
+	assert.NoError(t, file.Close())
+	writer, err := newRotatingWriter(file.Name(), 0, 0, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	log.New(writer, "", 0).Println("entry")
+	assert.Equal(t, []string{"entry"}, readSyncLogLines(t, file.Name()))
+}
+
+func mkBackends(t *testing.T, count int) []YAMLURL {
+	backends := make([]YAMLURL, 0, count)
+	for i := 0; i < count; i++ {
+		u, err := url.Parse(fmt.Sprintf("http://s3.dc%d.internal", i))
+		assert.NoError(t, err)
+		backends = append(backends, YAMLURL{u})
+	}
+	return backends
+}
+
+func TestConnLimitWarnings(t *testing.T) {
+	conf := Config{}
+	conf.Backends = mkBackends(t, 4)
+	conf.ConnLimit = 400
+	perBackend, clientRequests := conf.EffectiveConnLimits()
+	assert.Equal(t, int64(100), perBackend)
+	assert.Equal(t, int64(100), clientRequests)
+	assert.Empty(t, conf.ConnLimitWarnings())
+
+	conf.ConnLimit = 20
+	assert.Len(t, conf.ConnLimitWarnings(), 1, "Fan-out heavy config should starve client requests")
+
+	conf.ConnLimit = 3
+	warnings := conf.ConnLimitWarnings()
+	if assert.Len(t, warnings, 1) {
+		assert.Contains(t, warnings[0], "lower than number of backends")
+	}
+}
+
+func TestValidateCorrectConfig(t *testing.T) {
+	conf := Config{}
+	conf.Backends = mkBackends(t, 2)
+	conf.ConnectionTimeout = "3s"
+	conf.BackendWeights = map[string]int{conf.Backends[0].Host: 3}
+	assert.NoError(t, conf.Validate())
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	conf := Config{}
+	assert.Error(t, conf.Validate(), "Config without backends is invalid")
+
+	conf.Backends = mkBackends(t, 2)
+	conf.Backends = append(conf.Backends, YAMLURL{})
+	conf.BackendWeights = map[string]int{"unknown:80": 1, conf.Backends[0].Host: -1}
+	conf.WriteResponseBackend = "other:80"
+	conf.ConnectionTimeout = "3 seconds"
+	conf.Retry.Backoff = "fast"
+	conf.Retry.BudgetRatio = -1
+	conf.AdmissionControl = AdmissionControlConfig{SoftLimit: 10, HardLimit: 5}
+	conf.HealthCheck.MinHealthyForWrites = 4
+	conf.AccessLogFormat = "xml"
+
+	err := conf.Validate()
+	if !assert.Error(t, err) {
+		return
+	}
+	for _, problem := range []string{
+		"Backends item 2 is empty",
+		`unknown backend "unknown:80"`,
+		"is negative",
+		`WriteResponseBackend refers to unknown backend "other:80"`,
+		"ConnectionTimeout",
+		"Retry.Backoff",
+		"Retry.BudgetRatio is negative",
+		"HardLimit is lower than SoftLimit",
+		"MinHealthyForWrites requires HealthCheck.Interval",
+		"MinHealthyForWrites is greater than number of backends",
+		`AccessLogFormat should be "json" or "text", got "xml"`,
+	} {
+		assert.Contains(t, err.Error(), problem)
+	}
+}
+
+func TestValidateHealthCheckInterval(t *testing.T) {
+	conf := Config{}
+	conf.Backends = mkBackends(t, 2)
+	conf.HealthCheck.Interval = "0s"
+	assert.Error(t, conf.Validate(), "Backends can't be probed continuously")
+
+	conf.HealthCheck.Interval = "-5s"
+	assert.Error(t, conf.Validate())
+
+	conf.HealthCheck.Interval = "5s"
+	assert.NoError(t, conf.Validate())
+}
+
+func TestValidateBandwidthQuotaWindow(t *testing.T) {
+	conf := Config{}
+	conf.Backends = mkBackends(t, 2)
+	conf.BandwidthQuota.Bytes = 1024
+	for _, window := range []string{"", "0s", "-1m"} {
+		conf.BandwidthQuota.Window = window
+		assert.Error(t, conf.Validate(), "Window %q should be rejected", window)
+	}
+
+	conf.BandwidthQuota.Window = "1m"
+	assert.NoError(t, conf.Validate())
+}
+
+func TestValidateZeroWeights(t *testing.T) {
+	conf := Config{}
+	conf.Backends = mkBackends(t, 2)
+	conf.BackendWeights = map[string]int{conf.Backends[0].Host: 0}
+	assert.NoError(t, conf.Validate(), "Some backends may have weight 0")
+
+	conf.BackendWeights[conf.Backends[1].Host] = 0
+	assert.Error(t, conf.Validate(), "All backends can't have weight 0")
+}
+
+func TestDuplicateBackends(t *testing.T) {
+	conf := Config{}
+	conf.Backends = mkBackends(t, 2)
+	assert.Empty(t, conf.DuplicateBackends())
+	assert.NoError(t, conf.Validate())
+
+	for _, raw := range []string{"http://S3.dc0.internal:80/", "https://s3.dc1.internal"} {
+		u, err := url.Parse(raw)
+		assert.NoError(t, err)
+		conf.Backends = append(conf.Backends, YAMLURL{u})
+	}
+	assert.Equal(t, []string{"s3.dc0.internal:80"}, conf.DuplicateBackends())
+	assert.NoError(t, conf.Validate(), "Duplicates should only be warned about by default")
+
+	conf.RejectDuplicateBackends = true
+	err := conf.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `backend "s3.dc0.internal:80" is listed more than once`)
+	}
+}
+
+func TestWriteQuorumSize(t *testing.T) {
+	conf := Config{}
+	conf.Backends = mkBackends(t, 3)
+	for quorum, expected := range map[string]int{"": 0, "majority": 2, "3": 3} {
+		conf.WriteQuorum = quorum
+		size, err := conf.WriteQuorumSize()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, size)
+	}
+	for _, quorum := range []string{"all", "0", "4"} {
+		conf.WriteQuorum = quorum
+		_, err := conf.WriteQuorumSize()
+		assert.Error(t, err, "WriteQuorum %q should be invalid", quorum)
+	}
+}
+
+func TestValidateBackendCredentials(t *testing.T) {
+	conf := Config{}
+	conf.Backends = mkBackends(t, 2)
+	conf.BackendCredentials = map[string]BackendCredentialsConfig{
+		conf.Backends[0].Host: {AccessKey: "access", SecretKey: "secret", Region: "us-east-1"},
+	}
+	err := conf.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "BackendCredentials require BackendCredentialsTrustedClients")
+	}
+
+	conf.BackendCredentialsTrustedClients = true
+	assert.NoError(t, conf.Validate())
+
+	conf.BackendCredentials["s3.unknown.internal"] = BackendCredentialsConfig{AccessKey: "access"}
+	err = conf.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `BackendCredentials refers to unknown backend "s3.unknown.internal"`)
+		assert.Contains(t, err.Error(), `BackendCredentials of "s3.unknown.internal" require AccessKey, SecretKey and Region`)
+	}
+}
+
+func TestValidateBackendProxyWithMaintainedBackend(t *testing.T) {
+	conf := Config{}
+	conf.Backends = mkBackends(t, 2)
+	conf.MaintainedBackend = conf.Backends[0].Host
+	assert.NoError(t, conf.Validate())
+
+	proxyURL, err := url.Parse("http://proxy.local:3128")
+	assert.NoError(t, err)
+	conf.BackendProxy = YAMLURL{URL: proxyURL}
+	err = conf.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "MaintainedBackend can't be used with BackendProxy")
+	}
+}
+
+func TestLastLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akubra")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "audit.log")
+
+	line, err := lastLine(path)
+	assert.NoError(t, err)
+	assert.Empty(t, line, "Missing file has no last line")
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("first\nsecond\n"), 0644))
+	line, err = lastLine(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", line)
+}
+
+func TestReloadedConfigurationReusesLogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akubra")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	discard := log.New(ioutil.Discard, "", 0)
+	initial := Config{Accesslog: discard, Mainlog: discard}
+	conf := Config{}
+	conf.SyncLogFile = filepath.Join(dir, "sync.log")
+	conf.DeleteAuditLogFile = filepath.Join(dir, "audit.log")
+	if !assert.NoError(t, setupLoggers(&conf, &initial)) {
+		return
+	}
+
+	reloaded := Config{YamlConfig: conf.YamlConfig}
+	assert.NoError(t, setupLoggers(&reloaded, &conf))
+	assert.True(t, conf.Synclog == reloaded.Synclog, "Synclog should be reused")
+	assert.True(t, conf.DeleteAuditLog == reloaded.DeleteAuditLog, "Audit log should be reused")
+	assert.NoError(t, conf.CloseUnusedLogs(reloaded))
+	_, err = reloaded.syncLogWriter.Write([]byte("entry\n"))
+	assert.NoError(t, err, "Reused synclog should stay open")
+
+	changed := Config{YamlConfig: conf.YamlConfig}
+	changed.SyncLogFile = filepath.Join(dir, "other-sync.log")
+	assert.NoError(t, setupLoggers(&changed, &reloaded))
+	assert.False(t, changed.Synclog == reloaded.Synclog, "Synclog should be opened for new file")
+	assert.NoError(t, reloaded.CloseUnusedLogs(changed))
+	_, err = reloaded.syncLogWriter.Write([]byte("entry\n"))
+	assert.Error(t, err, "Unused synclog should be closed")
+	assert.NoError(t, changed.CloseUnusedLogs(Config{}))
+}
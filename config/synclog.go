@@ -0,0 +1,253 @@
+package config
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedSuffixFormat is time format of suffix rotated files are renamed with
+const rotatedSuffixFormat = "20060102T150405.000000000"
+
+// syncLogFlushInterval is how long compressed entries may wait in gzip
+// writer before they are flushed to file
+const syncLogFlushInterval = time.Second
+
+// rotatingWriter appends data to file, optionally gzip compressed. File is
+// rotated (renamed with timestamp suffix) once maxSize bytes were written to
+// it, maxSize 0 disables rotation. Only maxFiles newest rotated files are
+// kept, 0 keeps all
+type rotatingWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	compress bool
+	written  int64
+	file     *os.File
+	gz       *gzip.Writer
+	// compressed data is flushed flushInterval after first unflushed write
+	flushInterval time.Duration
+	flushTimer    *time.Timer
+	mx            sync.Mutex
+}
+
+func newRotatingWriter(path string, maxSize int64, maxFiles int, compress bool) (*rotatingWriter, error) {
+	rw := &rotatingWriter{path: path, maxSize: maxSize, maxFiles: maxFiles, compress: compress,
+		flushInterval: syncLogFlushInterval}
+	if compress {
+		// last gzip member of existing file may be unterminated if writer
+		// wasn't closed, so appending to it would make file unreadable
+		if err := rw.moveAside(); err != nil {
+			return nil, err
+		}
+	}
+	return rw, rw.open()
+}
+
+// moveAside renames non empty file at path with timestamp suffix
+func (rw *rotatingWriter) moveAside() error {
+	info, err := os.Stat(rw.path)
+	if os.IsNotExist(err) || err == nil && info.Size() == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", rw.path, time.Now().Format(rotatedSuffixFormat))
+	if err := os.Rename(rw.path, rotated); err != nil {
+		return err
+	}
+	return rw.removeOldFiles()
+}
+
+// removeOldFiles removes rotated files but maxFiles newest ones
+func (rw *rotatingWriter) removeOldFiles() error {
+	if rw.maxFiles <= 0 {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(filepath.Dir(rw.path))
+	if err != nil {
+		return err
+	}
+	prefix := filepath.Base(rw.path) + "."
+	rotated := []string{}
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(rotatedSuffixFormat, strings.TrimPrefix(name, prefix)); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+	// suffix format sorts chronologically
+	sort.Strings(rotated)
+	for len(rotated) > rw.maxFiles {
+		if err := os.Remove(filepath.Join(filepath.Dir(rw.path), rotated[0])); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+func (rw *rotatingWriter) open() error {
+	file, err := os.OpenFile(rw.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	rw.file = file
+	// size limit applies also to data written before file was reopened
+	rw.written = info.Size()
+	if rw.compress {
+		rw.gz = gzip.NewWriter(file)
+	}
+	return nil
+}
+
+// flush makes compressed entries written so far readable
+func (rw *rotatingWriter) flush() {
+	rw.mx.Lock()
+	defer rw.mx.Unlock()
+	rw.flushTimer = nil
+	if rw.gz != nil {
+		// failure is reported by next write
+		_ = rw.gz.Flush()
+	}
+}
+
+func (rw *rotatingWriter) close() error {
+	if rw.flushTimer != nil {
+		rw.flushTimer.Stop()
+		rw.flushTimer = nil
+	}
+	if rw.gz != nil {
+		if err := rw.gz.Close(); err != nil {
+			_ = rw.file.Close()
+			return err
+		}
+	}
+	return rw.file.Close()
+}
+
+func (rw *rotatingWriter) rotate() error {
+	if err := rw.close(); err != nil {
+		return err
+	}
+	renameErr := rw.moveAside()
+	// writing continues to same file if it couldn't be renamed
+	if err := rw.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+// Close implements io.Closer interface
+func (rw *rotatingWriter) Close() error {
+	rw.mx.Lock()
+	defer rw.mx.Unlock()
+	return rw.close()
+}
+
+// Write implements io.Writer interface
+func (rw *rotatingWriter) Write(p []byte) (n int, err error) {
+	rw.mx.Lock()
+	defer rw.mx.Unlock()
+	if rw.gz != nil {
+		n, err = rw.gz.Write(p)
+		if err == nil && rw.flushTimer == nil {
+			// flushing every entry would defeat compression
+			rw.flushTimer = time.AfterFunc(rw.flushInterval, rw.flush)
+		}
+	} else {
+		n, err = rw.file.Write(p)
+	}
+	if err != nil {
+		return
+	}
+	rw.written += int64(n)
+	if rw.maxSize > 0 && rw.written >= rw.maxSize {
+		err = rw.rotate()
+	}
+	return
+}
+
+// syncLogReader reads plain or gzip compressed sync log file
+type syncLogReader struct {
+	io.Reader
+	file *os.File
+}
+
+// Close implements io.Closer interface
+func (slr *syncLogReader) Close() error {
+	return slr.file.Close()
+}
+
+// OpenSyncLog opens sync log file written with SyncLogFile option. Gzip
+// compressed files are decompressed transparently. Compressed file which is
+// still written, or whose writer wasn't closed, ends with io.ErrUnexpectedEOF
+// after entries written so far
+func OpenSyncLog(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(file)
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		_ = file.Close()
+		return nil, err
+	}
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return &syncLogReader{buffered, file}, nil
+	}
+	gz, err := gzip.NewReader(buffered)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &syncLogReader{gz, file}, nil
+}
+
+// lastLineMaxSize is size of file tail searched for last line
+const lastLineMaxSize = 64 * 1024
+
+// lastLine returns last non empty line of not compressed file, or empty
+// string if file doesn't exist
+func lastLine(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = file.Close() }()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size() - lastLineMaxSize
+	if offset < 0 {
+		offset = 0
+	}
+	tail, err := ioutil.ReadAll(io.NewSectionReader(file, offset, info.Size()-offset))
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimRight(string(tail), "\n"), "\n")
+	return lines[len(lines)-1], nil
+}
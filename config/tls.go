@@ -0,0 +1,79 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// BackendTLSConfig defines client certificate presented to https backends
+// and CA bundle their certificates are verified with. Each of certificate,
+// key and CA bundle is given as file path or inline PEM
+type BackendTLSConfig struct {
+	// Client certificate file path
+	CertFile string `yaml:"CertFile,omitempty"`
+	// Client certificate private key file path
+	KeyFile string `yaml:"KeyFile,omitempty"`
+	// CA bundle file path, system roots are used if CA bundle is not given
+	CAFile string `yaml:"CAFile,omitempty"`
+	// Inline PEM encoded client certificate
+	Cert string `yaml:"Cert,omitempty"`
+	// Inline PEM encoded client certificate private key
+	Key string `yaml:"Key,omitempty"`
+	// Inline PEM encoded CA bundle
+	CA string `yaml:"CA,omitempty"`
+	// Don't verify backend certificates, meant for testing environments only
+	InsecureSkipVerify bool `yaml:"InsecureSkipVerify,omitempty"`
+}
+
+// readPEM returns inline PEM or content of file, at most one of them may be set
+func readPEM(name, path, inline string) ([]byte, error) {
+	if path != "" && inline != "" {
+		return nil, fmt.Errorf("BackendTLS.%sFile and BackendTLS.%s are both set", name, name)
+	}
+	if path == "" {
+		return []byte(inline), nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("BackendTLS.%sFile: %s", name, err)
+	}
+	return content, nil
+}
+
+// TLSConfig creates tls.Config for backend connections, returns nil if
+// nothing is configured
+func (btc BackendTLSConfig) TLSConfig() (*tls.Config, error) {
+	cert, err := readPEM("Cert", btc.CertFile, btc.Cert)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readPEM("Key", btc.KeyFile, btc.Key)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := readPEM("CA", btc.CAFile, btc.CA)
+	if err != nil {
+		return nil, err
+	}
+	if len(cert) == 0 && len(key) == 0 && len(ca) == 0 && !btc.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: btc.InsecureSkipVerify}
+	if len(cert) > 0 || len(key) > 0 {
+		certificate, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("BackendTLS client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if len(ca) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("BackendTLS CA bundle contains no certificates")
+		}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendTLSConfigNotConfigured(t *testing.T) {
+	tlsConfig, err := BackendTLSConfig{}.TLSConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+}
+
+func TestBackendTLSConfigErrors(t *testing.T) {
+	for problem, btc := range map[string]BackendTLSConfig{
+		"both set":             {CAFile: "/etc/akubra/ca.pem", CA: "-----BEGIN CERTIFICATE-----"},
+		"no such file":         {CertFile: "/nonexistent/client.pem", KeyFile: "/nonexistent/client-key.pem"},
+		"client certificate":   {Cert: "not a certificate", Key: "not a key"},
+		"contains no certific": {CA: "not a certificate"},
+	} {
+		_, err := btc.TLSConfig()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), problem)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package httphandler
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+type admissionControl struct {
+	softLimit    int64
+	hardLimit    int64
+	inFlight     int64
+	random       func() float64
+	roundTripper http.RoundTripper
+}
+
+// admit decides if request may be processed. Below soft limit all requests
+// are admitted, above hard limit all are rejected, in between fraction of
+// rejected requests grows linearly with number of in flight requests
+func (ac *admissionControl) admit(inFlight int64) bool {
+	if inFlight < ac.softLimit {
+		return true
+	}
+	if inFlight >= ac.hardLimit {
+		return false
+	}
+	rejectFraction := float64(inFlight-ac.softLimit+1) / float64(ac.hardLimit-ac.softLimit+1)
+	return ac.random() >= rejectFraction
+}
+
+// acquire counts request as in flight if it's admitted. Counter is updated
+// with compare-and-swap, so concurrent requests can't exceed hard limit
+func (ac *admissionControl) acquire() bool {
+	for {
+		inFlight := atomic.LoadInt64(&ac.inFlight)
+		if !ac.admit(inFlight) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&ac.inFlight, inFlight, inFlight+1) {
+			return true
+		}
+	}
+}
+
+func (ac *admissionControl) release() {
+	atomic.AddInt64(&ac.inFlight, -1)
+}
+
+func (ac *admissionControl) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if !ac.acquire() {
+		resp = newErrorResponse(req, http.StatusServiceUnavailable, "Service overloaded")
+		resp.Header.Set("Retry-After", "1")
+		return resp, nil
+	}
+	resp, err = ac.roundTripper.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		ac.release()
+		return
+	}
+	// request is in flight until its response body is sent to client
+	resp.Body = &releasingReadCloser{ReadCloser: resp.Body, release: ac.release}
+	return
+}
+
+// releasingReadCloser calls release once body is closed
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (rrc *releasingReadCloser) Close() error {
+	rrc.once.Do(rrc.release)
+	return rrc.ReadCloser.Close()
+}
+
+// AdmissionControl creates Decorator which sheds load when number of in flight
+// requests exceeds softLimit, rejecting growing fraction of new requests with
+// 503 status. At hardLimit all new requests are rejected
+func AdmissionControl(softLimit, hardLimit int64) Decorator {
+	if hardLimit < softLimit {
+		hardLimit = softLimit
+	}
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		return &admissionControl{
+			softLimit:    softLimit,
+			hardLimit:    hardLimit,
+			random:       rand.Float64,
+			roundTripper: roundTripper}
+	}
+}
@@ -0,0 +1,107 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/transport"
+)
+
+// DeleteAuditBackend is deletion status on single backend. Sent is false if
+// request was not sent to backend, e.g. it was ejected by health checks
+type DeleteAuditBackend struct {
+	Host    string `json:"host"`
+	Sent    bool   `json:"sent"`
+	Deleted bool   `json:"deleted"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// DeleteAuditRecord describes DELETE or DeleteObjects (POST with delete
+// query parameter) request and its result on all configured backends
+type DeleteAuditRecord struct {
+	Time     string               `json:"ts"`
+	Method   string               `json:"method"`
+	Path     string               `json:"path"`
+	Query    string               `json:"query,omitempty"`
+	Client   string               `json:"client"`
+	Backends []DeleteAuditBackend `json:"backends"`
+	// PrevHash is SHA256 of previous record, so removed or altered records
+	// break the chain
+	PrevHash string `json:"prevhash"`
+}
+
+// deleteAuditLog writes hash chained DeleteAuditRecords
+type deleteAuditLog struct {
+	chain *config.ChainedLog
+	// hosts of configured backends, all of them are listed in records
+	backends []string
+}
+
+// isDelete checks if request deletes objects or buckets
+func isDelete(req *http.Request) bool {
+	if req.Method == http.MethodDelete {
+		return true
+	}
+	_, deleteObjects := req.URL.Query()["delete"]
+	return req.Method == http.MethodPost && deleteObjects
+}
+
+// wasSent checks if backend request failed with err was sent to backend
+func wasSent(err error) bool {
+	if quorumErr, ok := err.(*transport.QuorumError); ok {
+		err = quorumErr.Cause
+	}
+	return err != transport.ErrBackendSkipped && err != transport.ErrCircuitOpen &&
+		err != transport.ErrBackendBusy
+}
+
+func auditBackend(r *transport.ReqResErrTuple) DeleteAuditBackend {
+	backend := DeleteAuditBackend{Host: r.Req.URL.Host, Sent: wasSent(r.Err), Deleted: !r.Failed}
+	if r.Res != nil {
+		backend.Status = r.Res.StatusCode
+	}
+	if r.Err != nil {
+		backend.Error = r.Err.Error()
+	}
+	return backend
+}
+
+// record logs result of deleting request on every backend
+func (dal *deleteAuditLog) record(tups []*transport.ReqResErrTuple) error {
+	if len(tups) == 0 || !isDelete(tups[0].Req) {
+		return nil
+	}
+	rec := DeleteAuditRecord{
+		Time:     time.Now().Format(time.RFC3339Nano),
+		Method:   tups[0].Req.Method,
+		Path:     tups[0].Req.URL.Path,
+		Query:    redactQuery(tups[0].Req.URL.RawQuery),
+		Backends: make([]DeleteAuditBackend, 0, len(dal.backends)),
+	}
+	if clientReq := transport.ClientRequest(tups[0].Req); clientReq != nil {
+		rec.Client = clientIdentity(clientReq)
+	}
+	remaining := append([]*transport.ReqResErrTuple{}, tups...)
+	for _, host := range dal.backends {
+		backend := DeleteAuditBackend{Host: host}
+		for i, r := range remaining {
+			if r.Req.URL.Host == host {
+				backend = auditBackend(r)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+		rec.Backends = append(rec.Backends, backend)
+	}
+	for _, r := range remaining {
+		rec.Backends = append(rec.Backends, auditBackend(r))
+	}
+
+	return dal.chain.Append(func(prevHash string) ([]byte, error) {
+		rec.PrevHash = prevHash
+		return json.Marshal(rec)
+	})
+}
@@ -0,0 +1,104 @@
+package httphandler
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsEncoding checks if Accept-Encoding header value allows given content
+// coding. Missing header is treated as identity only
+func acceptsEncoding(acceptEncoding, coding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != coding && name != "x-"+coding && name != "*" {
+			continue
+		}
+		accepted := true
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				q, err := strconv.ParseFloat(kv[1], 64)
+				accepted = err == nil && q > 0
+			}
+		}
+		return accepted
+	}
+	return false
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (grc *gzipReadCloser) Close() error {
+	gzErr := grc.Reader.Close()
+	err := grc.body.Close()
+	if err != nil {
+		return err
+	}
+	return gzErr
+}
+
+// decompress replaces gzip encoded body of successful GET response with
+// decompressed one. Other responses are not changed
+func decompress(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if req.Method != http.MethodGet || resp.StatusCode != http.StatusOK ||
+		resp.Body == nil || resp.ContentLength == 0 {
+		return resp, nil
+	}
+	if strings.ToLower(resp.Header.Get("Content-Encoding")) != "gzip" {
+		return resp, nil
+	}
+	gzReader, gzErr := gzip.NewReader(resp.Body)
+	if gzErr != nil {
+		closeErr := resp.Body.Close()
+		if closeErr != nil {
+			return nil, closeErr
+		}
+		return nil, gzErr
+	}
+	resp.Body = &gzipReadCloser{gzReader, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+type gzipRequester struct {
+	roundTripper http.RoundTripper
+}
+
+func (gr gzipRequester) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" ||
+		acceptsEncoding(req.Header.Get("Accept-Encoding"), "gzip") {
+		return gr.roundTripper.RoundTrip(req)
+	}
+	original, hadHeader := req.Header["Accept-Encoding"]
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := gr.roundTripper.RoundTrip(req)
+	// restore client header, so outer decorators see what client accepts
+	if hadHeader {
+		req.Header["Accept-Encoding"] = original
+	} else {
+		req.Header.Del("Accept-Encoding")
+	}
+	if err != nil {
+		return resp, err
+	}
+	return decompress(req, resp)
+}
+
+// GzipRequester requests gzip encoded responses from backends for GET
+// requests (except range ones) of clients not accepting gzip, and
+// decompresses such responses. Responses to other requests are passed as
+// backends sent them. Backends are expected to compress on the fly: object
+// stored with Content-Encoding gzip is also decompressed for such clients
+func GzipRequester(roundTripper http.RoundTripper) http.RoundTripper {
+	return gzipRequester{roundTripper: roundTripper}
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/allegro/akubra/config"
@@ -14,10 +16,36 @@ import (
 
 // Handler implements http.Handler interface
 type Handler struct {
+	// number of requests being served, first for 64 bit alignment
+	inflight     int64
 	config       config.Config
 	roundTripper http.RoundTripper
 	mainLog      *log.Logger
 	accessLog    *log.Logger
+	// transport backend requests are sent with, its state is reported by Status
+	multiTransport *transport.MultiTransport
+}
+
+// Close stops background tasks of handler, in flight requests are not
+// affected. Handler should not be used once closed
+func (h *Handler) Close() {
+	if h.multiTransport.HealthChecker != nil {
+		h.multiTransport.HealthChecker.Stop()
+	}
+}
+
+// WaitForWrites waits until requests being served are finished and writes
+// are replicated to all backends, also ones already responded to client, up
+// to timeout. Returns false if timeout passed first
+func (h *Handler) WaitForWrites(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&h.inflight) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return h.multiTransport.WaitForWrites(time.Until(deadline))
 }
 
 func (h *Handler) closeBadRequest(w http.ResponseWriter) {
@@ -41,9 +69,107 @@ func (h *Handler) closeBadRequest(w http.ResponseWriter) {
 	}
 }
 
+// badDigestBody is S3 error returned if body doesn't match Content-MD5 header
+const badDigestBody = `<?xml version="1.0" encoding="UTF-8"?>` +
+	"<Error><Code>BadDigest</Code><Message>The Content-MD5 you specified did not match what we received.</Message></Error>"
+
+// cannotResignBody is S3 error returned for requests which can't be signed
+// with backend credentials
+const cannotResignBody = `<?xml version="1.0" encoding="UTF-8"?>` +
+	"<Error><Code>InvalidRequest</Code><Message>Presigned urls and streaming signed uploads are not supported.</Message></Error>"
+
+// bodyErrorStatus returns status code for errors caused by client sending
+// request body
+func bodyErrorStatus(err error) (int, bool) {
+	if _, ok := err.(*transport.ContentLengthMismatchError); ok {
+		return http.StatusBadRequest, true
+	}
+	if err == transport.ErrTimeout {
+		return http.StatusGatewayTimeout, true
+	}
+	return 0, false
+}
+
+// hopByHopHeaders are meaningful only for single connection (RFC 7230 6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders deletes hop-by-hop headers, including ones listed
+// in Connection header
+func removeHopByHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&h.inflight, 1)
+	defer atomic.AddInt64(&h.inflight, -1)
+	if isServiceRequest(req) && !serviceMethods[req.Method] {
+		// root path addresses service itself, only ListBuckets is defined there
+		w.Header().Set("Allow", serviceAllowedMethods)
+		http.Error(w, "Method not allowed on service endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+
 	resp, err := h.roundTripper.RoundTrip(req)
 
+	if err == transport.ErrNoBackends {
+		h.mainLog.Printf("Cannot handle %s %s: %s", req.Method, req.URL.Path, err)
+		http.Error(w, "Backends unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil && resp != nil {
+		// failed response is not passed to client
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			h.mainLog.Printf("Cannot close response body reason: %q", closeErr.Error())
+		}
+	}
+	if _, ok := err.(*transport.QuorumError); ok {
+		h.mainLog.Printf("Cannot handle %s %s: %s", req.Method, req.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, ok := err.(*transport.ValidationError); ok {
+		h.mainLog.Printf("Cannot handle %s %s: %s", req.Method, req.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if _, ok := err.(*transport.BadDigestError); ok {
+		h.mainLog.Printf("Rejected %s %s: %s", req.Method, req.URL.Path, err)
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, badDigestBody)
+		return
+	}
+	if err == transport.ErrCannotResign {
+		h.mainLog.Printf("Rejected %s %s: %s", req.Method, req.URL.Path, err)
+		// request body was not read
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, cannotResignBody)
+		return
+	}
+	if statusCode, ok := bodyErrorStatus(err); ok {
+		// request body was not read completely, so connection can't be reused
+		w.Header().Set("Connection", "close")
+		http.Error(w, err.Error(), statusCode)
+		return
+	}
 	if err != nil {
 		h.closeBadRequest(w)
 		w.WriteHeader(http.StatusBadRequest)
@@ -54,9 +180,11 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	for k, v := range resp.Header {
 		wh[k] = v
 	}
+	// client connection is managed independently from backend one
+	removeHopByHopHeaders(wh)
 
 	w.WriteHeader(resp.StatusCode)
-	_, copyErr := io.Copy(w, resp.Body)
+	_, copyErr := transport.CopyBuffer(w, resp.Body)
 
 	defer func() {
 		if copyErr != nil {
@@ -74,14 +202,25 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}()
 }
 
-// NewHandler will create Handler
-func NewHandler(conf config.Config) http.Handler {
-	mainlog := conf.Mainlog
-	rh := &responseMerger{
-		conf.Synclog,
-		mainlog,
-		conf.SyncLogMethodsSet}
+// serviceMethods are methods allowed on root path, GET lists buckets
+var serviceMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+const serviceAllowedMethods = "GET, HEAD, OPTIONS"
 
+// isServiceRequest checks if request addresses service itself, not any
+// bucket. Virtual-hosted style requests address bucket given in host also on
+// root path, e.g. CreateBucket or DeleteObjects
+func isServiceRequest(req *http.Request) bool {
+	return strings.Trim(req.URL.Path, "/") == "" && hostBucket(req.Host) == ""
+}
+
+// NewHTTPTransport creates base transport used for backend connections
+// according to conf
+func NewHTTPTransport(conf config.Config) *http.Transport {
 	connDuration, _ := time.ParseDuration(conf.ConnectionTimeout)
 	dialDuration, _ := time.ParseDuration(conf.ConnectionTimeout)
 	var dialer *dial.LimitDialer
@@ -91,10 +230,50 @@ func NewHandler(conf config.Config) http.Handler {
 		dialer.DropEndpoint(conf.MaintainedBackend)
 	}
 
+	maxIdleConnsPerHost := int(conf.ConnLimit)
+	if conf.MaxIdleConnsPerHost > 0 {
+		maxIdleConnsPerHost = conf.MaxIdleConnsPerHost
+	}
 	httpTransport := &http.Transport{
 		Dial:                dialer.Dial,
 		DisableKeepAlives:   conf.KeepAlive,
-		MaxIdleConnsPerHost: int(conf.ConnLimit)}
+		MaxIdleConns:        conf.MaxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost}
+	if conf.BackendProxy.URL != nil {
+		httpTransport.Proxy = http.ProxyURL(conf.BackendProxy.URL)
+	}
+	// configuration is validated, so certificates are known to load
+	httpTransport.TLSClientConfig, _ = conf.BackendTLS.TLSConfig()
+	return httpTransport
+}
+
+// NewHandler will create Handler
+func NewHandler(conf config.Config) http.Handler {
+	mainlog := conf.Mainlog
+	rh := &responseMerger{
+		conf.Synclog,
+		mainlog,
+		conf.SyncLogMethodsSet,
+		conf.VerifiedReadPrefixes,
+		conf.VerifiedReadMaxBytes,
+		conf.EmptyReadsAsFailures,
+		conf.VerifyChecksumHeaders,
+		conf.WriteResponseBackend,
+		conf.ResponseStatusPreference,
+		nil}
+	if conf.DeleteAuditLog != nil {
+		backends := make([]string, 0, len(conf.Backends))
+		for _, backend := range conf.Backends {
+			backends = append(backends, backend.Host)
+		}
+		rh.deleteAudit = &deleteAuditLog{conf.DeleteAuditLog, backends}
+	}
+
+	var httpTransport http.RoundTripper = NewHTTPTransport(conf)
+	if conf.ClockSkewThreshold != "" {
+		threshold, _ := time.ParseDuration(conf.ClockSkewThreshold)
+		httpTransport = Decorate(httpTransport, ClockSkewDetector(threshold, mainlog))
+	}
 	backends := make([]*url.URL, len(conf.Backends))
 	for i, backend := range conf.Backends {
 		backends[i] = backend.URL
@@ -103,16 +282,109 @@ func NewHandler(conf config.Config) http.Handler {
 		httpTransport,
 		backends,
 		rh.handleResponses)
-	roundTripper := Decorate(
-		multiTransport,
+	multiTransport.Weights = conf.BackendWeights
+	multiTransport.HostHeaders = conf.BackendHostHeaders
+	if len(conf.BackendCredentials) > 0 {
+		multiTransport.Credentials = make(map[string]transport.Credentials, len(conf.BackendCredentials))
+		for host, credentials := range conf.BackendCredentials {
+			multiTransport.Credentials[host] = transport.Credentials{
+				AccessKey: credentials.AccessKey,
+				SecretKey: credentials.SecretKey,
+				Region:    credentials.Region,
+			}
+		}
+	}
+	multiTransport.VerifyETags = conf.VerifyETags
+	multiTransport.VerifyContentMD5 = conf.VerifyContentMD5
+	multiTransport.WriteQuorum, _ = conf.WriteQuorumSize()
+	if conf.PerBackendConnLimit > 0 {
+		queueTimeout, _ := time.ParseDuration(conf.PerBackendQueueTimeout)
+		multiTransport.BackendLimiter = transport.NewBackendLimiter(conf.PerBackendConnLimit, queueTimeout)
+	}
+	if len(conf.RequiredResponseHeaders) > 0 {
+		multiTransport.ResponseValidators = append(multiTransport.ResponseValidators,
+			transport.RequiredHeaders(conf.RequiredResponseHeaders))
+	}
+	if len(conf.ReplicatedMethods) > 0 {
+		multiTransport.ReplicatedMethods = make(map[string]bool, len(conf.ReplicatedMethods))
+		for _, method := range conf.ReplicatedMethods {
+			multiTransport.ReplicatedMethods[method] = true
+		}
+	}
+	if conf.HealthCheck.Interval != "" {
+		interval, _ := time.ParseDuration(conf.HealthCheck.Interval)
+		multiTransport.HealthChecker = transport.NewHealthChecker(httpTransport, backends,
+			conf.HealthCheck.Path, interval, conf.HealthCheck.FailureThreshold)
+		multiTransport.HealthChecker.Start()
+	}
+	if conf.Retry.Count > 0 {
+		backoff, _ := time.ParseDuration(conf.Retry.Backoff)
+		multiTransport.RetryPolicy = &transport.RetryPolicy{
+			MaxRetries:       conf.Retry.Count,
+			Backoff:          backoff,
+			RetryableClasses: conf.Retry.Errors,
+			MaxBodyBytes:     conf.Retry.MaxBodyBytes,
+			BudgetRatio:      conf.Retry.BudgetRatio,
+		}
+	}
+	if conf.CircuitBreaker.FailureThreshold > 0 {
+		cooldown, _ := time.ParseDuration(conf.CircuitBreaker.Cooldown)
+		multiTransport.CircuitBreaker = transport.NewCircuitBreaker(conf.CircuitBreaker.FailureThreshold,
+			cooldown, conf.CircuitBreaker.HalfOpenProbes)
+	}
+	decorators := []Decorator{}
+	if conf.ResponseHeaderLimit.MaxValueBytes > 0 {
+		decorators = append(decorators,
+			ResponseHeaderLimit(conf.ResponseHeaderLimit.MaxValueBytes, conf.ResponseHeaderLimit.Truncate, mainlog))
+	}
+	if conf.RequestGzipFromBackends {
+		decorators = append(decorators, GzipRequester)
+	}
+	if conf.DebugBackendHeader {
+		decorators = append(decorators, BackendHeader)
+	}
+	decorators = append(decorators,
 		HeadersSuplier(conf.AdditionalRequestHeaders, conf.AdditionalResponseHeaders),
-		AccessLogging(conf.Accesslog),
-		OptionsHandler,
+		ForwardedHeaders,
+	)
+	if len(conf.UnsupportedQueryParams) > 0 {
+		decorators = append(decorators, QueryParamsFilter(conf.UnsupportedQueryParams))
+	}
+	if conf.BandwidthQuota.Bytes > 0 {
+		window, err := time.ParseDuration(conf.BandwidthQuota.Window)
+		if err != nil {
+			mainlog.Printf("Bandwidth quota disabled, invalid window: %s", err)
+		} else {
+			decorators = append(decorators,
+				BandwidthQuota(conf.BandwidthQuota.Bytes, window, conf.BandwidthQuota.Throttle))
+		}
+	}
+	if multiTransport.HealthChecker != nil && conf.HealthCheck.MinHealthyForWrites > 0 {
+		decorators = append(decorators,
+			ReadOnlyMode(multiTransport.HealthChecker, conf.HealthCheck.MinHealthyForWrites, mainlog))
+	}
+	if conf.SlowDownCooldown != "" {
+		cooldown, _ := time.ParseDuration(conf.SlowDownCooldown)
+		decorators = append(decorators, SlowDownThrottle(cooldown))
+	}
+	if conf.AdmissionControl.SoftLimit > 0 {
+		decorators = append(decorators,
+			AdmissionControl(conf.AdmissionControl.SoftLimit, conf.AdmissionControl.HardLimit))
+	}
+	optionsDecorator := OptionsHandler
+	if conf.LocalOptionsResponse && !corsConfigured(conf.AdditionalResponseHeaders) {
+		optionsDecorator = LocalOptionsResponder
+	}
+	decorators = append(decorators,
+		AccessLoggingWithFormat(conf.Accesslog, conf.AccessLogVerbosity, conf.AccessLogFormat),
+		optionsDecorator,
 	)
+	roundTripper := Decorate(multiTransport, decorators...)
 	return &Handler{
-		config:       conf,
-		mainLog:      mainlog,
-		accessLog:    conf.Accesslog,
-		roundTripper: roundTripper,
+		config:         conf,
+		mainLog:        mainlog,
+		accessLog:      conf.Accesslog,
+		roundTripper:   roundTripper,
+		multiTransport: multiTransport,
 	}
 }
@@ -0,0 +1,688 @@
+package httphandler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingRoundTripper struct {
+	calls int
+}
+
+func (crt *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	crt.calls++
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewBufferString("OK")),
+	}, nil
+}
+
+func mkTestHandler(rt http.RoundTripper) *Handler {
+	return &Handler{
+		roundTripper: rt,
+		mainLog:      log.New(ioutil.Discard, "", 0),
+	}
+}
+
+// net/http frames requests declaring both Transfer-Encoding and
+// Content-Length by Transfer-Encoding and drops Content-Length header
+// (RFC 7230 3.3.3), so such requests can't be used for smuggling
+func TestTransferEncodingOverridesContentLength(t *testing.T) {
+	rt := &countingRoundTripper{}
+	srv := httptest.NewServer(mkTestHandler(rt))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { assert.NoError(t, conn.Close()) }()
+	// request framed by Content-Length would end after "3\r\n", leaving
+	// rest of chunked body to be parsed as next request
+	_, err = conn.Write([]byte("PUT /bucket/object HTTP/1.1\r\nHost: example.com\r\n" +
+		"Transfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n" +
+		"3\r\nabc\r\n0\r\n\r\n" +
+		"GET /bucket/object HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		resp, err := http.ReadResponse(reader, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "request %d", i)
+	}
+	assert.Equal(t, 2, rt.calls, "Chunked body should not be parsed as request")
+}
+
+func TestHandlerPassesWellFramedRequest(t *testing.T) {
+	rt := &countingRoundTripper{}
+	h := mkTestHandler(rt)
+	req := httptest.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("abc"))
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, rt.calls)
+}
+
+func TestBackendRequestsAreRoutedThroughProxy(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(t, err)
+	conf := config.Config{}
+	conf.ConnLimit = 10
+	conf.KeepAlive = true
+	conf.BackendProxy = config.YAMLURL{URL: proxyURL}
+
+	req, err := http.NewRequest("GET", "http://s3.backend.internal/bucket/object", nil)
+	assert.NoError(t, err)
+	resp, err := NewHTTPTransport(conf).RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NoError(t, resp.Body.Close())
+	}
+	assert.Equal(t, "s3.backend.internal", <-proxied)
+}
+
+type headersRoundTripper struct {
+	header http.Header
+}
+
+func (hrt *headersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     hrt.header,
+		Body:       ioutil.NopCloser(bytes.NewBufferString("OK")),
+	}, nil
+}
+
+func TestBackendConnectionCloseDoesNotCloseClientConnection(t *testing.T) {
+	backendHeader := make(http.Header)
+	backendHeader.Set("Connection", "close, X-Backend-Hop")
+	backendHeader.Set("X-Backend-Hop", "1")
+	backendHeader.Set("Keep-Alive", "timeout=5")
+	backendHeader.Set("ETag", "\"abc\"")
+	srv := httptest.NewServer(mkTestHandler(&headersRoundTripper{backendHeader}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, resp.Body.Close())
+	assert.False(t, resp.Close, "Client connection should be kept alive")
+	assert.Empty(t, resp.Header.Get("X-Backend-Hop"))
+	assert.Empty(t, resp.Header.Get("Keep-Alive"))
+	assert.Equal(t, "\"abc\"", resp.Header.Get("ETag"))
+}
+
+func TestIdleConnectionsLimits(t *testing.T) {
+	conf := config.Config{}
+	conf.ConnLimit = 10
+	assert.Equal(t, 10, NewHTTPTransport(conf).MaxIdleConnsPerHost, "Should default to ConnLimit")
+
+	conf.MaxIdleConnsPerHost = 50
+	conf.MaxIdleConns = 200
+	httpTransport := NewHTTPTransport(conf)
+	assert.Equal(t, 50, httpTransport.MaxIdleConnsPerHost)
+	assert.Equal(t, 200, httpTransport.MaxIdleConns)
+}
+
+func TestServiceEndpointMethods(t *testing.T) {
+	testCases := []struct {
+		method string
+		path   string
+		code   int
+		calls  int
+	}{
+		{"GET", "/", http.StatusOK, 1},
+		{"GET", "", http.StatusOK, 1},
+		{"HEAD", "/", http.StatusOK, 1},
+		{"PUT", "/", http.StatusMethodNotAllowed, 0},
+		{"DELETE", "/", http.StatusMethodNotAllowed, 0},
+		{"POST", "//", http.StatusMethodNotAllowed, 0},
+		{"PUT", "/bucket", http.StatusOK, 1},
+		{"DELETE", "/bucket/object", http.StatusOK, 1},
+	}
+	for _, tc := range testCases {
+		rt := &countingRoundTripper{}
+		h := mkTestHandler(rt)
+		req := httptest.NewRequest(tc.method, "http://example.com/", nil)
+		req.URL.Path = tc.path
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, tc.code, w.Code, "%s %q", tc.method, tc.path)
+		assert.Equal(t, tc.calls, rt.calls, "%s %q", tc.method, tc.path)
+		if tc.code == http.StatusMethodNotAllowed {
+			assert.Equal(t, serviceAllowedMethods, w.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestVirtualHostedBucketRequestsOnRootPathArePassed(t *testing.T) {
+	testCases := []struct {
+		method string
+		target string
+		code   int
+		calls  int
+	}{
+		{"PUT", "http://bucket.s3.example.com/", http.StatusOK, 1},
+		{"DELETE", "http://bucket.s3.example.com/", http.StatusOK, 1},
+		{"POST", "http://bucket.s3.example.com/?delete", http.StatusOK, 1},
+		{"PUT", "http://s3.example.com/", http.StatusMethodNotAllowed, 0},
+		{"POST", "http://s3.example.com/?delete", http.StatusMethodNotAllowed, 0},
+	}
+	for _, tc := range testCases {
+		rt := &countingRoundTripper{}
+		h := mkTestHandler(rt)
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, tc.code, w.Code, "%s %s", tc.method, tc.target)
+		assert.Equal(t, tc.calls, rt.calls, "%s %s", tc.method, tc.target)
+	}
+}
+
+func TestStatusReportsBackends(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	healthyURL, _ := url.Parse(healthy.URL)
+	failingURL, _ := url.Parse(failing.URL)
+	backends := []*url.URL{healthyURL, failingURL}
+
+	mt := transport.NewMultiTransport(nil, backends, nil)
+	mt.Weights = map[string]int{failingURL.Host: 3}
+	mt.ReplicatedMethods = map[string]bool{"PUT": true, "DELETE": true}
+	mt.HealthChecker = transport.NewHealthChecker(nil, backends, "/status", time.Minute, 1)
+	mt.HealthChecker.CheckNow()
+	h := mkTestHandler(mt)
+	h.multiTransport = mt
+
+	w := httptest.NewRecorder()
+	h.ServeStatus(w, httptest.NewRequest("GET", "http://localhost/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	status := Status{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+
+	assert.Equal(t, []string{"DELETE", "PUT"}, status.ReplicatedMethods)
+	if assert.Len(t, status.Backends, 2) {
+		assert.Equal(t, healthy.URL, status.Backends[0].URL)
+		assert.Equal(t, 1, status.Backends[0].Weight)
+		assert.True(t, *status.Backends[0].Healthy)
+		assert.Equal(t, 3, status.Backends[1].Weight)
+		assert.False(t, *status.Backends[1].Healthy)
+		assert.Empty(t, status.Backends[1].Circuit, "Circuit breaker is disabled")
+	}
+}
+
+func TestNoBackendsResultsInServiceUnavailable(t *testing.T) {
+	mainlog := &bytes.Buffer{}
+	h := mkTestHandler(transport.NewMultiTransport(nil, nil, nil))
+	h.mainLog = log.New(mainlog, "", 0)
+	req := httptest.NewRequest("GET", "http://example.com/bucket/object", nil)
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotEmpty(t, w.Body.String())
+	assert.Contains(t, mainlog.String(), transport.ErrNoBackends.Error())
+}
+
+func mkBodyReadingBackend(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		assert.Error(t, err, "Backend should not receive complete body")
+	}))
+}
+
+func TestBodyShorterThanContentLengthResultsInBadRequest(t *testing.T) {
+	backend := mkBodyReadingBackend(t)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	h := mkTestHandler(transport.NewMultiTransport(nil, []*url.URL{backendURL}, nil))
+	req := httptest.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("abc"))
+	req.ContentLength = 10
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "declared 10 bytes, read 3")
+}
+
+func TestBodyReadTimeoutResultsInGatewayTimeout(t *testing.T) {
+	backend := mkBodyReadingBackend(t)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	h := mkTestHandler(transport.NewMultiTransport(nil, []*url.URL{backendURL}, nil))
+	body, bodyWriter := io.Pipe()
+	defer func() {
+		assert.NoError(t, bodyWriter.Close())
+	}()
+	req := httptest.NewRequest("PUT", "http://example.com/bucket/object", body)
+	req.ContentLength = 10
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), transport.ErrTimeout.Error())
+}
+
+func TestChunkedErrorResponseIsRelayed(t *testing.T) {
+	xmlError := `<?xml version="1.0" encoding="UTF-8"?>` +
+		"<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		// flushing before whole body is written makes response chunked
+		for _, part := range []string{xmlError[:40], xmlError[40:]} {
+			_, err := w.Write([]byte(part))
+			assert.NoError(t, err)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	multiTransport := transport.NewMultiTransport(nil, []*url.URL{backendURL, backendURL}, nil)
+	// HeadersSuplier sets scheme of backend requests
+	h := mkTestHandler(Decorate(multiTransport, HeadersSuplier(nil, nil)))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/bucket/missing")
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "application/xml", resp.Header.Get("Content-Type"))
+	assert.Equal(t, xmlError, string(body))
+}
+
+func TestContentMD5IsVerified(t *testing.T) {
+	stored := make(chan string, 4)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		stored <- string(body)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	multiTransport := transport.NewMultiTransport(nil, []*url.URL{backendURL, backendURL}, nil)
+	multiTransport.VerifyContentMD5 = true
+	h := mkTestHandler(Decorate(multiTransport, HeadersSuplier(nil, nil)))
+	sum := md5.Sum([]byte("content"))
+	contentMD5 := base64.StdEncoding.EncodeToString(sum[:])
+
+	req := httptest.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("content"))
+	req.Header.Set("Content-MD5", contentMD5)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	multiTransport.WaitForWrites(time.Second)
+	if assert.Len(t, stored, 2, "Both backends should store matching body") {
+		assert.Equal(t, "content", <-stored)
+		assert.Equal(t, "content", <-stored)
+	}
+
+	req = httptest.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("corrupted"))
+	req.Header.Set("Content-MD5", contentMD5)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "<Code>BadDigest</Code>")
+	multiTransport.WaitForWrites(time.Second)
+	assert.Len(t, stored, 0, "Backends should not receive mismatching body")
+}
+
+func TestPresignedRequestToResignedBackendIsRejected(t *testing.T) {
+	backendURL, _ := url.Parse("http://s3.internal")
+	multiTransport := transport.NewMultiTransport(nil, []*url.URL{backendURL}, nil)
+	multiTransport.Credentials = map[string]transport.Credentials{
+		backendURL.Host: {AccessKey: "access", SecretKey: "secret", Region: "us-east-1"},
+	}
+	h := mkTestHandler(multiTransport)
+	req := httptest.NewRequest("GET", "http://example.com/bucket/object?X-Amz-Signature=abc", nil)
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "<Code>InvalidRequest</Code>")
+}
+
+// closeTrackingBody records if it was closed
+type closeTrackingBody struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (ctb *closeTrackingBody) Close() error {
+	close(ctb.closed)
+	return nil
+}
+
+type trackingRoundTripper struct {
+	bodies chan *closeTrackingBody
+}
+
+func (trt *trackingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := &closeTrackingBody{bytes.NewBufferString("OK"), make(chan struct{})}
+	trt.bodies <- body
+	return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: body}, nil
+}
+
+func TestResponsesFailingValidationAreNotPassed(t *testing.T) {
+	first, _ := url.Parse("http://first.internal")
+	second, _ := url.Parse("http://second.internal")
+	rt := &trackingRoundTripper{make(chan *closeTrackingBody, 2)}
+	multiTransport := transport.NewMultiTransport(rt, []*url.URL{first, second}, nil)
+	multiTransport.ResponseValidators = []transport.ResponseValidator{
+		transport.RequiredHeaders(map[string][]string{"GET": {"ETag"}}),
+	}
+	h := mkTestHandler(multiTransport)
+	req := httptest.NewRequest("GET", "http://example.com/bucket/object", nil)
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "lacks ETag header")
+	for i := 0; i < 2; i++ {
+		select {
+		case <-(<-rt.bodies).closed:
+		case <-time.After(time.Second):
+			t.Error("Response failing validation should be closed")
+		}
+	}
+}
+
+func TestObjectResponseHeadersAreRelayed(t *testing.T) {
+	objectHeaders := map[string]string{
+		"Content-Disposition": `attachment; filename="report 2017.pdf"`,
+		"Content-Language":    "pl-PL",
+		"Content-Type":        "application/pdf",
+		"Expires":             "Thu, 01 Dec 2034 16:00:00 GMT",
+		"Cache-Control":       "private, max-age=600",
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range objectHeaders {
+			w.Header().Set(k, v)
+		}
+		_, err := w.Write([]byte("%PDF-1.4"))
+		assert.NoError(t, err)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	discard := log.New(ioutil.Discard, "", 0)
+	conf := config.Config{Accesslog: discard, Mainlog: discard, Synclog: discard}
+	conf.ConnLimit = 10
+	conf.Backends = []config.YAMLURL{{URL: backendURL}, {URL: backendURL}}
+	srv := httptest.NewServer(NewHandler(conf))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/bucket/report.pdf")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	for k, v := range objectHeaders {
+		assert.Equal(t, v, resp.Header.Get(k), "%s should be relayed unchanged", k)
+	}
+}
+
+func TestStoredGzipObjectsArePassedUnchanged(t *testing.T) {
+	content := []byte("plain object content")
+	backend := mkGzipServer(t, content)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	discard := log.New(ioutil.Discard, "", 0)
+	conf := config.Config{Accesslog: discard, Mainlog: discard, Synclog: discard}
+	conf.ConnLimit = 10
+	conf.Backends = []config.YAMLURL{{URL: backendURL}}
+	srv := httptest.NewServer(NewHandler(conf))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/bucket/object.gz", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.NotEqual(t, content, body, "Object should be passed as stored")
+}
+
+type failingRoundTripper struct {
+	err error
+}
+
+func (frt failingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewBufferString("OK")),
+	}, frt.err
+}
+
+func TestWriteQuorumErrorResultsInInternalServerError(t *testing.T) {
+	h := mkTestHandler(failingRoundTripper{&transport.QuorumError{Required: 2, Succeeded: 1}})
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("content")))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "write quorum not met")
+}
+
+func TestWriteQuorumMissedDueToTransportError(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer ok.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+	okURL, _ := url.Parse(ok.URL)
+	deadURL, _ := url.Parse(dead.URL)
+	rd := &responseMerger{
+		syncerrlog: log.New(ioutil.Discard, "", 0),
+		runtimeLog: log.New(ioutil.Discard, "", 0),
+	}
+	multiTransport := transport.NewMultiTransport(nil, []*url.URL{deadURL, okURL}, rd.handleResponses)
+	multiTransport.WriteQuorum = 2
+	h := mkTestHandler(Decorate(multiTransport, HeadersSuplier(nil, nil)))
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("content")))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "write quorum not met")
+}
+
+// mkCertificate creates PEM encoded certificate and key signed by parent,
+// certificate is self signed if parent is nil
+func mkCertificate(t *testing.T, name string, isCA bool, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestBackendClientCertificate(t *testing.T) {
+	ca, caKey, _, _ := mkCertificate(t, "akubra test CA", true, nil, nil)
+	_, _, clientCert, clientKey := mkCertificate(t, "akubra", false, ca, caKey)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	backend.StartTLS()
+	defer backend.Close()
+	backendCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+
+	certFile, err := ioutil.TempFile("", "akubra-cert")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, os.Remove(certFile.Name()))
+	}()
+	_, err = certFile.Write(clientCert)
+	assert.NoError(t, err)
+	assert.NoError(t, certFile.Close())
+
+	send := func(backendTLS config.BackendTLSConfig) error {
+		conf := config.Config{}
+		conf.ConnLimit = 10
+		conf.BackendTLS = backendTLS
+		req, _ := http.NewRequest("GET", backend.URL+"/bucket/object", nil)
+		resp, err := NewHTTPTransport(conf).RoundTrip(req)
+		if err == nil {
+			assert.NoError(t, resp.Body.Close())
+		}
+		return err
+	}
+
+	assert.NoError(t, send(config.BackendTLSConfig{CertFile: certFile.Name(), Key: string(clientKey), CA: string(backendCA)}))
+	assert.Error(t, send(config.BackendTLSConfig{CA: string(backendCA)}),
+		"Backend requiring client certificate should reject connection without one")
+}
+
+func TestBackendInsecureSkipVerify(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	send := func(insecure bool) error {
+		conf := config.Config{}
+		conf.ConnLimit = 10
+		conf.BackendTLS.InsecureSkipVerify = insecure
+		req, _ := http.NewRequest("GET", backend.URL+"/bucket/object", nil)
+		resp, err := NewHTTPTransport(conf).RoundTrip(req)
+		if err == nil {
+			assert.NoError(t, resp.Body.Close())
+		}
+		return err
+	}
+
+	assert.Error(t, send(false), "Self-signed certificate should be rejected by default")
+	assert.NoError(t, send(true))
+}
+
+func TestResponseStatusPreferencePicksFailedResponse(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// responds after failing backend
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer missing.Close()
+	failingURL, _ := url.Parse(failing.URL)
+	missingURL, _ := url.Parse(missing.URL)
+	discard := log.New(ioutil.Discard, "", 0)
+
+	for _, testCase := range []struct {
+		preference []int
+		expected   int
+	}{
+		{nil, http.StatusNotFound},
+		{[]int{5}, http.StatusInternalServerError},
+	} {
+		conf := config.Config{Accesslog: discard, Mainlog: discard, Synclog: discard}
+		conf.ConnLimit = 10
+		conf.Backends = []config.YAMLURL{{URL: failingURL}, {URL: missingURL}}
+		conf.ResponseStatusPreference = testCase.preference
+		srv := httptest.NewServer(NewHandler(conf))
+
+		resp, err := http.Get(srv.URL + "/bucket/object")
+		if assert.NoError(t, err) {
+			assert.NoError(t, resp.Body.Close())
+			assert.Equal(t, testCase.expected, resp.StatusCode, "Preference %v", testCase.preference)
+		}
+		srv.Close()
+	}
+}
@@ -3,6 +3,8 @@ package httphandler
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -17,14 +19,123 @@ type AccessMessageData struct {
 	Duration   float64 `json:"duration"`
 	RespErr    string  `json:"error"`
 	Time       string  `json:"ts"`
+	// Host of backend which response was passed to client
+	Backend string `json:"backend,omitempty"`
+	// Response content length, if known
+	Bytes int64 `json:"bytes,omitempty"`
+	// Fields below are filled for verbose access log only
+	Query         string      `json:"query,omitempty"`
+	RemoteAddr    string      `json:"remoteaddr,omitempty"`
+	ContentLength int64       `json:"contentlength,omitempty"`
+	Headers       http.Header `json:"headers,omitempty"`
+}
+
+// Access log verbosity levels
+const (
+	// AccessLogQuiet logs method, path, status code and duration only
+	AccessLogQuiet = "quiet"
+	// AccessLogNormal logs AccessMessageData basic fields
+	AccessLogNormal = "normal"
+	// AccessLogVerbose logs also query and request headers, both with
+	// credentials redacted, client address and content length
+	AccessLogVerbose = "verbose"
+)
+
+// Access log formats
+const (
+	// AccessLogJSON logs messages as JSON objects
+	AccessLogJSON = "json"
+	// AccessLogText logs messages as comma separated quoted values
+	AccessLogText = "text"
+)
+
+// redactedHeaders contain credentials or SSE-C encryption keys and must not
+// be logged
+var redactedHeaders = []string{
+	"Authorization",
+	"X-Amz-Server-Side-Encryption-Customer-Key",
+	"X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key",
+	"X-Amz-Security-Token",
+}
+
+// redactedQueryParams contain credentials of presigned requests and must not
+// be logged
+var redactedQueryParams = []string{
+	"X-Amz-Signature",
+	"X-Amz-Credential",
+	"X-Amz-Security-Token",
+	"Signature",
+}
+
+// redactQuery replaces values of redactedQueryParams in raw query, other
+// parameters are left as sent
+func redactQuery(rawQuery string) string {
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		name := strings.SplitN(param, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		for _, redacted := range redactedQueryParams {
+			if strings.EqualFold(name, redacted) {
+				params[i] = strings.SplitN(param, "=", 2)[0] + "=REDACTED"
+			}
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// quietAccessMessageData is AccessMessageData subset logged for quiet clients
+type quietAccessMessageData struct {
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	StatusCode int     `json:"status"`
+	Duration   float64 `json:"duration"`
+	Time       string  `json:"ts"`
+}
+
+// withVerbosity returns access log message with fields adequate to level
+func (amd *AccessMessageData) withVerbosity(req *http.Request, level string) interface{} {
+	switch level {
+	case AccessLogQuiet:
+		return quietAccessMessageData{amd.Method, amd.Path, amd.StatusCode, amd.Duration, amd.Time}
+	case AccessLogVerbose:
+		amd.Query = redactQuery(req.URL.RawQuery)
+		amd.RemoteAddr = req.RemoteAddr
+		amd.ContentLength = req.ContentLength
+		amd.Headers = make(http.Header, len(req.Header))
+		for k, v := range req.Header {
+			amd.Headers[k] = v
+		}
+		for _, name := range redactedHeaders {
+			if amd.Headers.Get(name) != "" {
+				amd.Headers.Set(name, "REDACTED")
+			}
+		}
+	}
+	return amd
 }
 
 // String produces data in csv format with fields in following order:
-// Method, Host, Path, UserAgent, StatusCode, Duration, RespErr)
+// Method, Host, Path, UserAgent, StatusCode, Duration, RespErr, Backend, Bytes
 func (amd AccessMessageData) String() string {
-	return fmt.Sprintf("%q, %q, %q, %q, %d, %f, %q",
+	return fmt.Sprintf("%q, %q, %q, %q, %d, %f, %q, %q, %d",
 		amd.Method, amd.Host, amd.Path, amd.UserAgent,
-		amd.StatusCode, amd.Duration, amd.RespErr)
+		amd.StatusCode, amd.Duration, amd.RespErr, amd.Backend, amd.Bytes)
+}
+
+// withResponse fills fields describing backend response
+func (amd *AccessMessageData) withResponse(resp *http.Response) *AccessMessageData {
+	if resp == nil {
+		return amd
+	}
+	if resp.Request != nil {
+		amd.Backend = resp.Request.URL.Host
+	}
+	if resp.ContentLength > 0 {
+		amd.Bytes = resp.ContentLength
+	}
+	return amd
 }
 
 // NewAccessLogMessage creates new AccessMessageData
@@ -32,20 +143,23 @@ func NewAccessLogMessage(req http.Request,
 	statusCode int, duration float64, respErr string) *AccessMessageData {
 	ts := time.Now().Format(time.RFC3339Nano)
 	return &AccessMessageData{
-		req.Method,
-		req.Host,
-		req.URL.Path,
-		req.Header.Get("User-Agent"),
-		statusCode, duration * 1000, respErr, ts}
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		UserAgent:  req.Header.Get("User-Agent"),
+		StatusCode: statusCode,
+		Duration:   duration * 1000,
+		RespErr:    respErr,
+		Time:       ts}
 }
 
 // ScanCSVAccessLogMessage will scan csv string and return AccessMessageData.
 // Returns fmt.SScanf error if matching failed
 func ScanCSVAccessLogMessage(csvstr string) (AccessMessageData, error) {
 	amd := AccessMessageData{}
-	_, err := fmt.Sscanf(csvstr, "%q, %q, %q, %q, %d, %f, %q", &amd.Method, &amd.Host,
+	_, err := fmt.Sscanf(csvstr, "%q, %q, %q, %q, %d, %f, %q, %q, %d", &amd.Method, &amd.Host,
 		&amd.Path, &amd.UserAgent, &amd.StatusCode, &amd.Duration,
-		&amd.RespErr, &amd.Time)
+		&amd.RespErr, &amd.Backend, &amd.Bytes)
 	return amd, err
 }
 
@@ -59,6 +173,9 @@ type SyncLogMessageData struct {
 	UserAgent   string `json:"useragent"`
 	ErrorMsg    string `json:"error"`
 	Time        string `json:"ts"`
+	// Query and Host header of failed request, redacted like in access log
+	Query string `json:"query,omitempty"`
+	Host  string `json:"host,omitempty"`
 }
 
 // String produces data in csv format with fields in following order:
@@ -79,5 +196,5 @@ func NewSyncLogMessageData(method, failedHost, path, successHost, userAgent,
 	ts := time.Now().Format(time.RFC3339Nano)
 	return &SyncLogMessageData{
 		method, failedHost, path, successHost, userAgent,
-		errorMsg, ts}
+		errorMsg, ts, "", ""}
 }
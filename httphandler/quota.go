@@ -0,0 +1,145 @@
+package httphandler
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientIdentity returns AWS access key used to sign request or client ip
+// address if request is not signed. Signature is not verified, so any
+// client may claim any access key
+func clientIdentity(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "AWS4-HMAC-SHA256 "):
+		// AWS4-HMAC-SHA256 Credential=AKID/20170101/region/s3/aws4_request, ...
+		idx := strings.Index(auth, "Credential=")
+		if idx >= 0 {
+			credential := auth[idx+len("Credential="):]
+			return strings.SplitN(credential, "/", 2)[0]
+		}
+	case strings.HasPrefix(auth, "AWS "):
+		// AWS AKID:signature
+		return strings.SplitN(strings.TrimPrefix(auth, "AWS "), ":", 2)[0]
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+type clientUsage struct {
+	bytes       int64
+	windowStart time.Time
+}
+
+type bandwidthQuota struct {
+	limit    int64
+	window   time.Duration
+	throttle bool
+	usage    map[string]*clientUsage
+	usageMx  sync.Mutex
+	// expired windows are removed from usage once per window
+	lastSweep    time.Time
+	roundTripper http.RoundTripper
+}
+
+// currentUsage returns usage in current window, it has to be called with
+// usageMx locked
+func (bq *bandwidthQuota) currentUsage(client string) *clientUsage {
+	now := time.Now()
+	if now.Sub(bq.lastSweep) >= bq.window {
+		for c, cu := range bq.usage {
+			if now.Sub(cu.windowStart) >= bq.window {
+				delete(bq.usage, c)
+			}
+		}
+		bq.lastSweep = now
+	}
+	cu, ok := bq.usage[client]
+	if !ok || now.Sub(cu.windowStart) >= bq.window {
+		cu = &clientUsage{windowStart: now}
+		bq.usage[client] = cu
+	}
+	return cu
+}
+
+// exceeded checks if client used its quota, if so returns time left to
+// window reset
+func (bq *bandwidthQuota) exceeded(client string) (bool, time.Duration) {
+	bq.usageMx.Lock()
+	defer bq.usageMx.Unlock()
+	cu := bq.currentUsage(client)
+	if cu.bytes < bq.limit {
+		return false, 0
+	}
+	return true, bq.window - time.Since(cu.windowStart)
+}
+
+func (bq *bandwidthQuota) account(client string, n int64) {
+	bq.usageMx.Lock()
+	defer bq.usageMx.Unlock()
+	bq.currentUsage(client).bytes += n
+}
+
+func (bq *bandwidthQuota) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	client := clientIdentity(req)
+	if exceeded, wait := bq.exceeded(client); exceeded {
+		if !bq.throttle {
+			return newErrorResponse(req, http.StatusTooManyRequests, "Bandwidth quota exceeded"), nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	if req.Body != nil {
+		// bytes actually read are counted, chunked uploads declare no length
+		req.Body = &countingReadCloser{req.Body, func(n int64) {
+			bq.account(client, n)
+		}}
+	}
+	resp, err = bq.roundTripper.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		return
+	}
+	resp.Body = &countingReadCloser{resp.Body, func(n int64) {
+		bq.account(client, n)
+	}}
+	return
+}
+
+// countingReadCloser reports number of bytes read to callback
+type countingReadCloser struct {
+	io.ReadCloser
+	callback func(int64)
+}
+
+func (crc *countingReadCloser) Read(p []byte) (n int, err error) {
+	n, err = crc.ReadCloser.Read(p)
+	if n > 0 {
+		crc.callback(int64(n))
+	}
+	return
+}
+
+// BandwidthQuota creates Decorator which limits number of bytes each client
+// may send and receive within window. Once exceeded requests are rejected
+// with 429 status or, if throttle is set, delayed until window resets
+func BandwidthQuota(limit int64, window time.Duration, throttle bool) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		return &bandwidthQuota{
+			limit:        limit,
+			window:       window,
+			throttle:     throttle,
+			usage:        make(map[string]*clientUsage),
+			roundTripper: roundTripper}
+	}
+}
@@ -0,0 +1,54 @@
+package httphandler
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/allegro/akubra/transport"
+)
+
+type readOnlyMode struct {
+	healthChecker *transport.HealthChecker
+	minHealthy    int
+	// 1 while writes are rejected, so mode changes are logged once
+	readOnly     int32
+	mainLog      *log.Logger
+	roundTripper http.RoundTripper
+}
+
+// update switches mode according to number of healthy backends, returns
+// true if writes should be rejected
+func (rom *readOnlyMode) update() bool {
+	healthy := rom.healthChecker.HealthyCount()
+	if healthy < rom.minHealthy {
+		if atomic.CompareAndSwapInt32(&rom.readOnly, 0, 1) {
+			rom.mainLog.Printf("Only %d backends healthy, entering read-only mode", healthy)
+		}
+		return true
+	}
+	if atomic.CompareAndSwapInt32(&rom.readOnly, 1, 0) {
+		rom.mainLog.Printf("%d backends healthy, leaving read-only mode", healthy)
+	}
+	return false
+}
+
+func (rom *readOnlyMode) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isWrite(req.Method) && rom.update() {
+		return newErrorResponse(req, http.StatusServiceUnavailable, "Service is in read-only mode"), nil
+	}
+	return rom.roundTripper.RoundTrip(req)
+}
+
+// ReadOnlyMode creates Decorator which rejects writes with 503 status while
+// fewer than minHealthy backends are healthy according to healthChecker.
+// Reads are passed regardless of backends health
+func ReadOnlyMode(healthChecker *transport.HealthChecker, minHealthy int, mainLog *log.Logger) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		return &readOnlyMode{
+			healthChecker: healthChecker,
+			minHealthy:    minHealthy,
+			mainLog:       mainLog,
+			roundTripper:  roundTripper}
+	}
+}
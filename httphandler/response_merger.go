@@ -1,10 +1,14 @@
 package httphandler
 
 import (
+	"bytes"
+	"crypto/md5"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"strings"
 
 	"github.com/allegro/akubra/transport"
 	set "github.com/deckarep/golang-set"
@@ -14,6 +18,239 @@ type responseMerger struct {
 	syncerrlog      *log.Logger
 	runtimeLog      *log.Logger
 	methodSetFilter set.Set
+	// GET requests with path starting with any of prefixes will be served
+	// only once backends returned identical content
+	verifiedReadPrefixes []string
+	// longer objects are not verified, defaultVerifiedReadMaxBytes if 0
+	verifiedReadMaxBytes int64
+	// treat GET responses with 200 status and empty body as failed, so
+	// non empty response from other backend is preferred
+	emptyReadsAsFailures bool
+	// compare x-amz-checksum-* headers of successful responses
+	verifyChecksumHeaders bool
+	// host of backend which response is preferred for writes
+	writeResponseBackend string
+	// picks failed response passed if no backend succeeded,
+	// transport.DefaultStatusPreference if nil
+	statusPreference transport.StatusPreference
+	// if set result of DELETE requests on all backends is recorded
+	deleteAudit *deleteAuditLog
+}
+
+// checksumHeadersPrefix is prefix of S3 additional checksums headers
+const checksumHeadersPrefix = "X-Amz-Checksum-"
+
+// checksumHeaders returns copy of x-amz-checksum-* headers
+func checksumHeaders(header http.Header) map[string]string {
+	checksums := make(map[string]string)
+	for k := range header {
+		if strings.HasPrefix(k, checksumHeadersPrefix) {
+			checksums[k] = header.Get(k)
+		}
+	}
+	return checksums
+}
+
+// verifyChecksums logs backends which returned x-amz-checksum-* headers
+// different than passed response
+func (rd *responseMerger) verifyChecksums(successfulTup *transport.ReqResErrTuple,
+	expected map[string]string, tups []*transport.ReqResErrTuple) {
+	for _, r := range tups {
+		if r.Failed || r.Res == nil {
+			continue
+		}
+		for k, v := range checksumHeaders(r.Res.Header) {
+			if expectedValue, ok := expected[k]; ok && expectedValue != v {
+				rd.runtimeLog.Printf("Backend %q returned %s %q, expected %q",
+					r.Req.URL.Host, k, v, expectedValue)
+				rd.synclogMismatch(r, successfulTup, k+" mismatch")
+				break
+			}
+		}
+	}
+}
+
+// verifyETags logs successful responses which ETag differs from MD5 of
+// request body. Response was already passed, so client is not affected
+func (rd *responseMerger) verifyETags(successfulTup *transport.ReqResErrTuple, tups []*transport.ReqResErrTuple) {
+	for _, r := range append([]*transport.ReqResErrTuple{successfulTup}, tups...) {
+		if r.Failed || r.Res == nil {
+			continue
+		}
+		if err := transport.VerifyETag(r.Req, r.Res); err != nil {
+			rd.runtimeLog.Printf("Backend %q: %s", r.Req.URL.Host, err)
+			rd.synclogMismatch(r, successfulTup, err.Error())
+		}
+	}
+}
+
+// isEmptyRead checks if response is successful GET response declaring empty body
+func isEmptyRead(r *transport.ReqResErrTuple) bool {
+	return r.Req.Method == "GET" && r.Res != nil &&
+		r.Res.StatusCode == http.StatusOK && r.Res.ContentLength == 0
+}
+
+func (rd *responseMerger) synclogMismatch(r, successfulTup *transport.ReqResErrTuple, reason string) {
+	syncLogMsg := NewSyncLogMessageData(
+		r.Req.Method,
+		r.Req.URL.Host,
+		successfulTup.Req.URL.Path,
+		successfulTup.Req.URL.Host,
+		r.Req.Header.Get("User-Agent"),
+		reason)
+	syncLogMsg.Query = redactQuery(r.Req.URL.RawQuery)
+	syncLogMsg.Host = r.Req.Host
+	logMsg, err := json.Marshal(syncLogMsg)
+	if err != nil {
+		return
+	}
+	rd.syncerrlog.Println(string(logMsg))
+}
+
+func (rd *responseMerger) isVerifiedRead(req *http.Request) bool {
+	if req.Method != "GET" {
+		return false
+	}
+	for _, prefix := range rd.verifiedReadPrefixes {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultVerifiedReadMaxBytes is size of longest verified object if
+// verifiedReadMaxBytes is not set
+const defaultVerifiedReadMaxBytes = 16 << 20
+
+// readBodies reads bodies of successful responses. If any of them is longer
+// than verifiedReadMaxBytes, bodies are restored, so responses can be passed
+// unchanged, and false is returned. Responses which body couldn't be read
+// are marked failed
+func (rd *responseMerger) readBodies(tups []*transport.ReqResErrTuple) (map[*transport.ReqResErrTuple][]byte, bool) {
+	maxBytes := rd.verifiedReadMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultVerifiedReadMaxBytes
+	}
+	for _, r := range tups {
+		if !r.Failed && r.Res != nil && r.Res.ContentLength > maxBytes {
+			return nil, false
+		}
+	}
+	bodies := make(map[*transport.ReqResErrTuple][]byte)
+	for _, r := range tups {
+		if r.Failed || r.Res == nil {
+			continue
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Res.Body, maxBytes+1))
+		if err != nil {
+			rd.runtimeLog.Printf("Could not read body for verification %s", err)
+			r.Failed = true
+			continue
+		}
+		bodies[r] = body
+		if int64(len(body)) > maxBytes {
+			for read, readBody := range bodies {
+				read.Res.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(readBody), read.Res.Body), read.Res.Body}
+			}
+			return nil, false
+		}
+	}
+	return bodies, true
+}
+
+// verifyReads reads bodies of all successful responses and passes content
+// returned by majority of backends. Backends which returned different
+// content or failed are logged to synclog for repair. Returns nil if there
+// was no successful response or objects were too long to be verified
+func (rd *responseMerger) verifyReads(tups []*transport.ReqResErrTuple) *transport.ReqResErrTuple {
+	var chosen *transport.ReqResErrTuple
+	bodies, ok := rd.readBodies(tups)
+	if !ok {
+		return nil
+	}
+	checksums := make(map[*transport.ReqResErrTuple][md5.Size]byte)
+	votes := make(map[[md5.Size]byte]int)
+	for _, r := range tups {
+		body, read := bodies[r]
+		if !read {
+			continue
+		}
+		sum := md5.Sum(body)
+		checksums[r] = sum
+		votes[sum]++
+		if chosen == nil || votes[sum] > votes[checksums[chosen]] {
+			chosen = r
+		}
+	}
+	if chosen == nil {
+		return nil
+	}
+	for r, sum := range checksums {
+		if err := r.Res.Body.Close(); err != nil {
+			rd.runtimeLog.Printf("Could not close body %s", err)
+		}
+		if sum != checksums[chosen] {
+			rd.runtimeLog.Printf("Backend %q returned different content of %q",
+				r.Req.URL.Host, r.Req.URL.Path)
+			rd.synclogMismatch(r, chosen, "Content checksum mismatch")
+		}
+	}
+	chosen.Res.Body = ioutil.NopCloser(bytes.NewReader(bodies[chosen]))
+	failed := []*transport.ReqResErrTuple{}
+	for _, r := range tups {
+		if _, read := bodies[r]; !read {
+			failed = append(failed, r)
+		}
+	}
+	// failed responses are logged, drained and closed, none is passed
+	go rd.handleFailedResponces(failed, nil, true, chosen, rd.methodSetFilter)
+	return chosen
+}
+
+// prependTuple returns channel emiting first and then all tuples from in
+func prependTuple(first *transport.ReqResErrTuple, in <-chan *transport.ReqResErrTuple) <-chan *transport.ReqResErrTuple {
+	out := make(chan *transport.ReqResErrTuple)
+	go func() {
+		out <- first
+		for r := range in {
+			out <- r
+		}
+		close(out)
+	}()
+	return out
+}
+
+// preferBackend returns channel where tuple of backend with given host is
+// passed first, other tuples are held until it comes in
+func preferBackend(host string, in <-chan *transport.ReqResErrTuple) <-chan *transport.ReqResErrTuple {
+	out := make(chan *transport.ReqResErrTuple)
+	go func() {
+		held := []*transport.ReqResErrTuple{}
+		for r := range in {
+			if r.Req.URL.Host != host {
+				held = append(held, r)
+				continue
+			}
+			out <- r
+			break
+		}
+		for _, r := range held {
+			out <- r
+		}
+		for r := range in {
+			out <- r
+		}
+		close(out)
+	}()
+	return out
+}
+
+func isWrite(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
 }
 
 func (rd *responseMerger) synclog(r, successfulTup *transport.ReqResErrTuple) {
@@ -36,11 +273,13 @@ func (rd *responseMerger) synclog(r, successfulTup *transport.ReqResErrTuple) {
 	}
 	syncLogMsg := NewSyncLogMessageData(
 		r.Req.Method,
-		r.Req.Host,
+		r.Req.URL.Host,
 		successfulTup.Req.URL.Path,
-		successfulTup.Req.Host,
+		successfulTup.Req.URL.Host,
 		r.Req.Header.Get("User-Agent"),
 		errorMsg)
+	syncLogMsg.Query = redactQuery(r.Req.URL.RawQuery)
+	syncLogMsg.Host = r.Req.Host
 	logMsg, err := json.Marshal(syncLogMsg)
 	if err != nil {
 		return
@@ -64,7 +303,7 @@ func (rd *responseMerger) handleFailedResponces(
 		rd.runtimeLog.Printf("RGW resp %q, %q, %q, %t, %q",
 			r.Req.URL.Path,
 			r.Req.Method,
-			r.Req.Host,
+			r.Req.URL.Host,
 			r.Failed,
 			errorMsg)
 
@@ -81,6 +320,9 @@ func (rd *responseMerger) handleFailedResponces(
 			if err != nil {
 				rd.runtimeLog.Printf("Could not discard body %s", err)
 			}
+			if err := r.Res.Body.Close(); err != nil {
+				rd.runtimeLog.Printf("Could not close body %s", err)
+			}
 		}
 	}
 
@@ -89,6 +331,7 @@ func (rd *responseMerger) handleFailedResponces(
 
 func (rd *responseMerger) _handle(in <-chan *transport.ReqResErrTuple, out chan<- *transport.ReqResErrTuple) {
 	var successfulTup *transport.ReqResErrTuple
+	var expectedChecksums map[string]string
 	errs := []*transport.ReqResErrTuple{}
 	nonErrs := []*transport.ReqResErrTuple{}
 	respPassed := false
@@ -98,10 +341,17 @@ func (rd *responseMerger) _handle(in <-chan *transport.ReqResErrTuple, out chan<
 		if !hasMore {
 			break
 		}
+		if rd.emptyReadsAsFailures && isEmptyRead(r) {
+			r.Failed = true
+		}
 		// pass first successful answer to client
 		if !r.Failed && !respPassed {
 			// append additional headers
 			successfulTup = r
+			if rd.verifyChecksumHeaders {
+				// headers may be changed once response is passed
+				expectedChecksums = checksumHeaders(r.Res.Header)
+			}
 			out <- r
 			respPassed = true
 			continue
@@ -113,11 +363,74 @@ func (rd *responseMerger) _handle(in <-chan *transport.ReqResErrTuple, out chan<
 		}
 	}
 
+	if rd.deleteAudit != nil {
+		all := append(append([]*transport.ReqResErrTuple{}, nonErrs...), errs...)
+		if successfulTup != nil {
+			all = append([]*transport.ReqResErrTuple{successfulTup}, all...)
+		}
+		if err := rd.deleteAudit.record(all); err != nil {
+			rd.runtimeLog.Printf("Cannot write delete audit record: %s", err)
+		}
+	}
+	if successfulTup != nil {
+		rd.verifyETags(successfulTup, nonErrs)
+	}
+	if len(expectedChecksums) > 0 {
+		rd.verifyChecksums(successfulTup, expectedChecksums, nonErrs)
+	}
+	if !respPassed {
+		nonErrs = rd.preferredFirst(nonErrs)
+	}
 	respPassed = rd.handleFailedResponces(nonErrs, out, respPassed, successfulTup, rd.methodSetFilter)
 	rd.handleFailedResponces(errs, out, respPassed, successfulTup, rd.methodSetFilter)
 }
 
+// preferredFirst moves most preferred response to front, so it's passed
+func (rd *responseMerger) preferredFirst(tups []*transport.ReqResErrTuple) []*transport.ReqResErrTuple {
+	preference := rd.statusPreference
+	if preference == nil {
+		preference = transport.DefaultStatusPreference
+	}
+	if len(tups) == 0 {
+		return tups
+	}
+	best := 0
+	for i, r := range tups {
+		if preference.Prefers(r, tups[best]) {
+			best = i
+		}
+	}
+	ordered := append([]*transport.ReqResErrTuple{tups[best]}, tups[:best]...)
+	return append(ordered, tups[best+1:]...)
+}
+
 func (rd *responseMerger) handleResponses(in <-chan *transport.ReqResErrTuple) *transport.ReqResErrTuple {
+	first, ok := <-in
+	if !ok {
+		return nil
+	}
+	in = prependTuple(first, in)
+	if rd.writeResponseBackend != "" && isWrite(first.Req.Method) {
+		// response headers (ETag, version id) have to come from same backend
+		in = preferBackend(rd.writeResponseBackend, in)
+	}
+	if rd.isVerifiedRead(first.Req) {
+		tups := []*transport.ReqResErrTuple{}
+		for r := range in {
+			tups = append(tups, r)
+		}
+		if verified := rd.verifyReads(tups); verified != nil {
+			return verified
+		}
+		// no successful response or object too long, handle responses as usual
+		replay := make(chan *transport.ReqResErrTuple, len(tups))
+		for _, r := range tups {
+			replay <- r
+		}
+		close(replay)
+		in = replay
+	}
+
 	out := make(chan *transport.ReqResErrTuple, 1)
 	go func() {
 		rd._handle(in, out)
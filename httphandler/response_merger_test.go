@@ -0,0 +1,477 @@
+package httphandler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/transport"
+	set "github.com/deckarep/golang-set"
+	"github.com/stretchr/testify/assert"
+)
+
+func mkTuple(t *testing.T, method, host, path string, statusCode int, body string) *transport.ReqResErrTuple {
+	req, err := http.NewRequest(method, "http://"+host+path, nil)
+	assert.NoError(t, err)
+	res := &http.Response{
+		StatusCode: statusCode,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Request:    req,
+	}
+	return &transport.ReqResErrTuple{
+		Req:    req,
+		Res:    res,
+		Failed: statusCode < 200 || statusCode > 399}
+}
+
+func tuplesChan(tups ...*transport.ReqResErrTuple) <-chan *transport.ReqResErrTuple {
+	in := make(chan *transport.ReqResErrTuple, len(tups))
+	for _, tup := range tups {
+		in <- tup
+	}
+	close(in)
+	return in
+}
+
+func mkResponseMerger(synclog *bytes.Buffer) *responseMerger {
+	return &responseMerger{
+		syncerrlog:      log.New(synclog, "", 0),
+		runtimeLog:      log.New(ioutil.Discard, "", 0),
+		methodSetFilter: nil,
+	}
+}
+
+func TestVerifiedReadDetectsCorruptedReplica(t *testing.T) {
+	synclog := &bytes.Buffer{}
+	rd := mkResponseMerger(synclog)
+	rd.verifiedReadPrefixes = []string{"/critical/"}
+
+	resTup := rd.handleResponses(tuplesChan(
+		mkTuple(t, "GET", "corrupted.internal", "/critical/object", http.StatusOK, "c0rrupted"),
+		mkTuple(t, "GET", "first.internal", "/critical/object", http.StatusOK, "content"),
+		mkTuple(t, "GET", "second.internal", "/critical/object", http.StatusOK, "content"),
+	))
+
+	body, err := ioutil.ReadAll(resTup.Res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(body))
+	assert.Contains(t, synclog.String(), "corrupted.internal")
+	assert.NotContains(t, synclog.String(), "\"failedhost\":\"first.internal\"")
+}
+
+func TestVerifiedReadWithoutSuccessfulResponse(t *testing.T) {
+	rd := mkResponseMerger(&bytes.Buffer{})
+	rd.verifiedReadPrefixes = []string{"/"}
+
+	resTup := rd.handleResponses(tuplesChan(
+		mkTuple(t, "GET", "first.internal", "/bucket/object", http.StatusNotFound, "not found"),
+		mkTuple(t, "GET", "second.internal", "/bucket/object", http.StatusInternalServerError, "error"),
+	))
+
+	assert.True(t, resTup.Failed)
+	assert.Equal(t, http.StatusNotFound, resTup.Res.StatusCode)
+}
+
+func TestNotVerifiedReadPassesFirstSuccess(t *testing.T) {
+	rd := mkResponseMerger(&bytes.Buffer{})
+	rd.verifiedReadPrefixes = []string{"/critical/"}
+
+	resTup := rd.handleResponses(tuplesChan(
+		mkTuple(t, "GET", "first.internal", "/other/object", http.StatusOK, "first"),
+		mkTuple(t, "GET", "second.internal", "/other/object", http.StatusOK, "second"),
+	))
+
+	body, err := ioutil.ReadAll(resTup.Res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(body))
+}
+
+func withTrackedBody(tup *transport.ReqResErrTuple) (*transport.ReqResErrTuple, chan struct{}) {
+	closed := make(chan struct{})
+	tup.Res.Body = &closeTrackingBody{tup.Res.Body, closed}
+	return tup, closed
+}
+
+func assertClosed(t *testing.T, closed chan struct{}, msg string) {
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error(msg)
+	}
+}
+
+func TestVerifiedReadClosesAndSynclogsRemainingResponses(t *testing.T) {
+	synclog := make(linesWriter, 1)
+	rd := mkResponseMerger(nil)
+	rd.syncerrlog = log.New(synclog, "", 0)
+	rd.methodSetFilter = set.NewThreadUnsafeSetFromSlice([]interface{}{"GET"})
+	rd.verifiedReadPrefixes = []string{"/critical/"}
+	first, firstClosed := withTrackedBody(mkTuple(t, "GET", "first.internal", "/critical/object", http.StatusOK, "content"))
+	second, secondClosed := withTrackedBody(mkTuple(t, "GET", "second.internal", "/critical/object", http.StatusOK, "content"))
+	failed, failedClosed := withTrackedBody(mkTuple(t, "GET", "failed.internal", "/critical/object", http.StatusInternalServerError, "error"))
+
+	resTup := rd.handleResponses(tuplesChan(first, failed, second))
+
+	body, err := ioutil.ReadAll(resTup.Res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(body))
+	assertClosed(t, firstClosed, "Body of first response should be closed")
+	assertClosed(t, secondClosed, "Body of second response should be closed")
+	assertClosed(t, failedClosed, "Body of failed response should be closed")
+	select {
+	case line := <-synclog:
+		assert.Contains(t, line, "failed.internal")
+	case <-time.After(time.Second):
+		t.Error("Failed read should be logged in synclog")
+	}
+}
+
+func TestVerifiedReadPassesFirstSuccessOfTooLongObject(t *testing.T) {
+	synclog := &bytes.Buffer{}
+	rd := mkResponseMerger(synclog)
+	rd.verifiedReadPrefixes = []string{"/critical/"}
+	rd.verifiedReadMaxBytes = 4
+
+	resTup := rd.handleResponses(tuplesChan(
+		mkTuple(t, "GET", "first.internal", "/critical/object", http.StatusOK, "content"),
+		mkTuple(t, "GET", "second.internal", "/critical/object", http.StatusOK, "c0ntent"),
+	))
+
+	body, err := ioutil.ReadAll(resTup.Res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(body))
+	assert.Empty(t, synclog.String())
+}
+
+func mkEmptyTuple(t *testing.T, host string) *transport.ReqResErrTuple {
+	tup := mkTuple(t, "GET", host, "/bucket/object", http.StatusOK, "")
+	tup.Res.ContentLength = 0
+	return tup
+}
+
+func TestEmptyReadsAsFailures(t *testing.T) {
+	rd := mkResponseMerger(&bytes.Buffer{})
+	rd.emptyReadsAsFailures = true
+	full := mkTuple(t, "GET", "full.internal", "/bucket/object", http.StatusOK, "content")
+	full.Res.ContentLength = int64(len("content"))
+
+	resTup := rd.handleResponses(tuplesChan(mkEmptyTuple(t, "empty.internal"), full))
+
+	body, err := ioutil.ReadAll(resTup.Res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(body))
+
+	resTup = rd.handleResponses(tuplesChan(mkEmptyTuple(t, "first.internal"), mkEmptyTuple(t, "second.internal")))
+	assert.Equal(t, http.StatusOK, resTup.Res.StatusCode, "Empty object should be served if all backends agree")
+}
+
+func TestEmptyReadsPassedByDefault(t *testing.T) {
+	rd := mkResponseMerger(&bytes.Buffer{})
+	full := mkTuple(t, "GET", "full.internal", "/bucket/object", http.StatusOK, "content")
+
+	resTup := rd.handleResponses(tuplesChan(mkEmptyTuple(t, "empty.internal"), full))
+
+	assert.Equal(t, "empty.internal", resTup.Req.Host)
+}
+
+func TestVerifyChecksumHeaders(t *testing.T) {
+	synclog := &bytes.Buffer{}
+	rd := mkResponseMerger(synclog)
+	rd.verifyChecksumHeaders = true
+	first := mkTuple(t, "PUT", "first.internal", "/bucket/object", http.StatusOK, "")
+	first.Res.Header.Set("X-Amz-Checksum-Crc32", "AAAAAA==")
+	second := mkTuple(t, "PUT", "second.internal", "/bucket/object", http.StatusOK, "")
+	second.Res.Header.Set("X-Amz-Checksum-Crc32", "AAAAAA==")
+	third := mkTuple(t, "PUT", "third.internal", "/bucket/object", http.StatusOK, "")
+	third.Res.Header.Set("X-Amz-Checksum-Crc32", "BBBBBB==")
+
+	out := make(chan *transport.ReqResErrTuple, 1)
+	rd._handle(tuplesChan(first, second, third), out)
+
+	resTup := <-out
+	assert.Equal(t, "first.internal", resTup.Req.Host)
+	assert.Contains(t, synclog.String(), "third.internal")
+	assert.NotContains(t, synclog.String(), "second.internal")
+}
+
+func TestWriteResponseBackendHeadersAreReturned(t *testing.T) {
+	rd := mkResponseMerger(&bytes.Buffer{})
+	rd.writeResponseBackend = "primary.internal"
+
+	fast := mkTuple(t, "PUT", "fast.internal", "/bucket/object", http.StatusOK, "")
+	fast.Res.Header.Set("ETag", "fast")
+	primary := mkTuple(t, "PUT", "primary.internal", "/bucket/object", http.StatusOK, "")
+	primary.Res.Header.Set("ETag", "primary")
+
+	in := make(chan *transport.ReqResErrTuple, 2)
+	in <- fast
+	go func() {
+		<-time.After(20 * time.Millisecond)
+		in <- primary
+		close(in)
+	}()
+	resTup := rd.handleResponses(in)
+	assert.Equal(t, "primary", resTup.Res.Header.Get("ETag"))
+
+	failedPrimary := mkTuple(t, "PUT", "primary.internal", "/bucket/object", http.StatusInternalServerError, "")
+	fast = mkTuple(t, "PUT", "fast.internal", "/bucket/object", http.StatusOK, "")
+	fast.Res.Header.Set("ETag", "fast")
+	resTup = rd.handleResponses(tuplesChan(failedPrimary, fast))
+	assert.Equal(t, "fast", resTup.Res.Header.Get("ETag"), "Other backend response should be passed if preferred failed")
+
+	fast = mkTuple(t, "GET", "fast.internal", "/bucket/object", http.StatusOK, "fast")
+	primary = mkTuple(t, "GET", "primary.internal", "/bucket/object", http.StatusOK, "primary")
+	resTup = rd.handleResponses(tuplesChan(fast, primary))
+	assert.Equal(t, "fast.internal", resTup.Req.URL.Host, "Reads should not wait for preferred backend")
+}
+
+// linesWriter passes each written log line to channel
+type linesWriter chan string
+
+func (lw linesWriter) Write(p []byte) (int, error) {
+	lw <- string(p)
+	return len(p), nil
+}
+
+func mkETagBackend(t *testing.T, etag func(body []byte) string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		w.Header().Set("ETag", etag(body))
+	}))
+}
+
+func TestETagMismatchIsLoggedForRepair(t *testing.T) {
+	good := mkETagBackend(t, func(body []byte) string {
+		return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(body)))
+	})
+	defer good.Close()
+	bad := mkETagBackend(t, func(body []byte) string {
+		return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(body[1:])))
+	})
+	defer bad.Close()
+	goodURL, _ := url.Parse(good.URL)
+	badURL, _ := url.Parse(bad.URL)
+
+	synclog := make(linesWriter, 2)
+	rd := &responseMerger{
+		syncerrlog:      log.New(synclog, "", 0),
+		runtimeLog:      log.New(ioutil.Discard, "", 0),
+		methodSetFilter: set.NewThreadUnsafeSetFromSlice([]interface{}{"PUT"}),
+	}
+	mt := transport.NewMultiTransport(nil, []*url.URL{goodURL, badURL}, rd.handleResponses)
+	mt.VerifyETags = true
+	req, err := http.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("content"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	resp, err := mt.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	select {
+	case line := <-synclog:
+		assert.Contains(t, line, badURL.Host)
+		assert.Contains(t, line, "ETag")
+		assert.NotContains(t, line, `"failedhost":"`+goodURL.Host)
+	case <-time.After(time.Second):
+		t.Error("Backend with wrong ETag should be logged in synclog")
+	}
+}
+
+func TestETagMismatchDoesNotFailWrite(t *testing.T) {
+	bad := mkETagBackend(t, func(body []byte) string {
+		return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(body[1:])))
+	})
+	defer bad.Close()
+	badURL, _ := url.Parse(bad.URL)
+
+	synclog := make(linesWriter, 1)
+	rd := &responseMerger{
+		syncerrlog:      log.New(synclog, "", 0),
+		runtimeLog:      log.New(ioutil.Discard, "", 0),
+		methodSetFilter: set.NewThreadUnsafeSetFromSlice([]interface{}{"PUT"}),
+	}
+	mt := transport.NewMultiTransport(nil, []*url.URL{badURL}, rd.handleResponses)
+	mt.VerifyETags = true
+	req, err := http.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("content"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	resp, err := mt.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	select {
+	case line := <-synclog:
+		assert.Contains(t, line, "ETag")
+	case <-time.After(time.Second):
+		t.Error("ETag mismatch should be logged in synclog")
+	}
+}
+
+func TestFailedWriteIsLoggedInSynclog(t *testing.T) {
+	ok := mkETagBackend(t, func([]byte) string { return `"etag"` })
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	okURL, _ := url.Parse(ok.URL)
+	failingURL, _ := url.Parse(failing.URL)
+
+	synclog := make(linesWriter, 2)
+	rd := &responseMerger{
+		syncerrlog:      log.New(synclog, "", 0),
+		runtimeLog:      log.New(ioutil.Discard, "", 0),
+		methodSetFilter: set.NewThreadUnsafeSetFromSlice([]interface{}{"PUT", "DELETE"}),
+	}
+	mt := transport.NewMultiTransport(nil, []*url.URL{okURL, failingURL}, rd.handleResponses)
+	req, err := http.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("content"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	resp, err := mt.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	select {
+	case line := <-synclog:
+		entry := SyncLogMessageData{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, "PUT", entry.Method)
+		assert.Equal(t, failingURL.Host, entry.FailedHost)
+		assert.Equal(t, okURL.Host, entry.SuccessHost)
+		assert.Equal(t, "/bucket/object", entry.Path)
+	case <-time.After(time.Second):
+		t.Error("Failed write should be logged in synclog")
+	}
+}
+
+func TestSynclogNamesBackendsByAddress(t *testing.T) {
+	synclog := &bytes.Buffer{}
+	rd := mkResponseMerger(synclog)
+	rd.verifiedReadPrefixes = []string{"/critical/"}
+	rd.verifyChecksumHeaders = true
+	rd.methodSetFilter = set.NewThreadUnsafeSetFromSlice([]interface{}{"PUT"})
+	// backends behind shared load balancer receive same Host header
+	withHostHeader := func(tup *transport.ReqResErrTuple) *transport.ReqResErrTuple {
+		tup.Req.Host = "lb.internal"
+		return tup
+	}
+
+	rd.handleResponses(tuplesChan(
+		withHostHeader(mkTuple(t, "GET", "corrupted.internal", "/critical/object", http.StatusOK, "c0rrupted")),
+		withHostHeader(mkTuple(t, "GET", "first.internal", "/critical/object", http.StatusOK, "content")),
+		withHostHeader(mkTuple(t, "GET", "second.internal", "/critical/object", http.StatusOK, "content")),
+	))
+	first := withHostHeader(mkTuple(t, "PUT", "first.internal", "/bucket/object", http.StatusOK, ""))
+	first.Res.Header.Set("X-Amz-Checksum-Crc32", "AAAAAA==")
+	mismatched := withHostHeader(mkTuple(t, "PUT", "mismatched.internal", "/bucket/object", http.StatusOK, ""))
+	mismatched.Res.Header.Set("X-Amz-Checksum-Crc32", "BBBBBB==")
+	failed := withHostHeader(mkTuple(t, "PUT", "failed.internal", "/bucket/object", http.StatusInternalServerError, ""))
+	out := make(chan *transport.ReqResErrTuple, 1)
+	rd._handle(tuplesChan(first, mismatched, failed), out)
+	<-out
+
+	failedHosts := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(synclog.String()), "\n") {
+		entry := SyncLogMessageData{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.NotEqual(t, "lb.internal", entry.SuccessHost)
+		failedHosts = append(failedHosts, entry.FailedHost)
+	}
+	assert.Equal(t, []string{"corrupted.internal", "mismatched.internal", "failed.internal"}, failedHosts)
+}
+
+func TestWriteSkippingOpenCircuitBackendIsLoggedInSynclog(t *testing.T) {
+	ok := mkETagBackend(t, func([]byte) string { return `"etag"` })
+	defer ok.Close()
+	okURL, _ := url.Parse(ok.URL)
+	skippedURL := &url.URL{Scheme: "http", Host: "skipped.internal"}
+
+	synclog := make(linesWriter, 2)
+	rd := &responseMerger{
+		syncerrlog:      log.New(synclog, "", 0),
+		runtimeLog:      log.New(ioutil.Discard, "", 0),
+		methodSetFilter: set.NewThreadUnsafeSetFromSlice([]interface{}{"PUT", "GET"}),
+	}
+	mt := transport.NewMultiTransport(nil, []*url.URL{okURL, skippedURL}, rd.handleResponses)
+	mt.CircuitBreaker = transport.NewCircuitBreaker(1, time.Minute, 1)
+	mt.CircuitBreaker.Report(skippedURL, true)
+
+	req, err := http.NewRequest("GET", "http://example.com/bucket/object", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp, err := mt.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.NoError(t, resp.Body.Close())
+	}
+	req, err = http.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("content"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp, err = mt.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	select {
+	case line := <-synclog:
+		entry := SyncLogMessageData{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, "PUT", entry.Method, "Skipped reads should not be logged")
+		assert.Equal(t, skippedURL.Host, entry.FailedHost)
+		assert.Equal(t, okURL.Host, entry.SuccessHost)
+		assert.Equal(t, "/bucket/object", entry.Path)
+	case <-time.After(time.Second):
+		t.Error("Write skipping backend should be logged in synclog")
+	}
+}
+
+func TestHeadPrefersFoundObject(t *testing.T) {
+	rd := mkResponseMerger(&bytes.Buffer{})
+
+	resTup := rd.handleResponses(tuplesChan(
+		mkTuple(t, "HEAD", "first.internal", "/bucket/object", http.StatusNotFound, ""),
+		mkTuple(t, "HEAD", "second.internal", "/bucket/object", http.StatusOK, ""),
+	))
+	assert.False(t, resTup.Failed)
+	assert.Equal(t, http.StatusOK, resTup.Res.StatusCode, "Object found on any backend should be reported")
+
+	resTup = rd.handleResponses(tuplesChan(
+		mkTuple(t, "HEAD", "first.internal", "/bucket/missing", http.StatusNotFound, ""),
+		mkTuple(t, "HEAD", "second.internal", "/bucket/missing", http.StatusNotFound, ""),
+	))
+	assert.Equal(t, http.StatusNotFound, resTup.Res.StatusCode)
+
+	resTup = rd.handleResponses(tuplesChan(
+		mkTuple(t, "HEAD", "first.internal", "/bucket", http.StatusNotFound, ""),
+		mkTuple(t, "HEAD", "second.internal", "/bucket", http.StatusOK, ""),
+	))
+	assert.Equal(t, http.StatusOK, resTup.Res.StatusCode, "Bucket found on any backend should be reported")
+}
@@ -2,18 +2,56 @@ package httphandler
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Decorator is http.RoundTripper interface wrapper
 type Decorator func(http.RoundTripper) http.RoundTripper
 
+// newErrorResponse creates response for requests which will not be passed
+// to backends
+func newErrorResponse(req *http.Request, statusCode int, msg string) *http.Response {
+	body := msg
+	if body != "" {
+		body += "\n"
+	}
+	resp := newLocalResponse(req, statusCode, body)
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return resp
+}
+
+// newLocalResponse creates response akubra sends itself, without contacting
+// backends
+func newLocalResponse(req *http.Request, statusCode int, body string) *http.Response {
+	header := make(http.Header)
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
 type loggingRoundTripper struct {
 	roundTripper http.RoundTripper
 	accessLog    *log.Logger
+	// access log verbosity level per client identity
+	verbosity map[string]string
+	// AccessLogJSON or AccessLogText
+	format string
 }
 
 func (lrt *loggingRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
@@ -36,8 +74,15 @@ func (lrt *loggingRoundTripper) RoundTrip(req *http.Request) (resp *http.Respons
 	accessLogMessage := NewAccessLogMessage(*req,
 		statusCode,
 		duration,
-		errStr)
-	jsonb, almerr := json.Marshal(accessLogMessage)
+		errStr).withResponse(resp)
+	if lrt.format == AccessLogText {
+		// all levels share one layout, so lines can be parsed alike
+		lrt.accessLog.Printf("%s", accessLogMessage)
+		return
+	}
+	level := lrt.verbosity[clientIdentity(req)]
+	message := accessLogMessage.withVerbosity(req, level)
+	jsonb, almerr := json.Marshal(message)
 	if almerr != nil {
 		log.Printf("Cannot marshal access log message %s", almerr.Error())
 		return
@@ -48,8 +93,25 @@ func (lrt *loggingRoundTripper) RoundTrip(req *http.Request) (resp *http.Respons
 
 // AccessLogging creares Decorator with access log collector
 func AccessLogging(logger *log.Logger) Decorator {
+	return AccessLoggingWithVerbosity(logger, nil)
+}
+
+// AccessLoggingWithVerbosity creates Decorator with access log collector
+// logging requests of clients (AWS access key or ip address) with given
+// verbosity level. Requests of other clients are logged with AccessLogNormal
+// level
+func AccessLoggingWithVerbosity(logger *log.Logger, verbosity map[string]string) Decorator {
+	return AccessLoggingWithFormat(logger, verbosity, AccessLogJSON)
+}
+
+// AccessLoggingWithFormat creates Decorator with access log collector as
+// AccessLoggingWithVerbosity does, logging messages in given format
+// (AccessLogJSON or AccessLogText). Text format contains fields of
+// AccessLogNormal level regardless of verbosity, so it can be parsed with
+// ScanCSVAccessLogMessage
+func AccessLoggingWithFormat(logger *log.Logger, verbosity map[string]string, format string) Decorator {
 	return func(rt http.RoundTripper) http.RoundTripper {
-		return &loggingRoundTripper{roundTripper: rt, accessLog: logger}
+		return &loggingRoundTripper{roundTripper: rt, accessLog: logger, verbosity: verbosity, format: format}
 	}
 }
 
@@ -71,9 +133,8 @@ func (hs *headersSuplier) RoundTrip(req *http.Request) (resp *http.Response, err
 
 	// While tcp host is rewritten we need to keep Host header
 	// intact for sake of s3 authorization
-	if strings.Contains(req.Host, ".s3.") {
-		prefix := strings.Split(req.Host, ".s3.")[0]
-		newhost := prefix + "." + req.URL.Host
+	if bucket := hostBucket(req.Host); bucket != "" {
+		newhost := bucket + "." + req.URL.Host
 		req.Header.Set("Host", newhost)
 		req.Host = newhost
 	}
@@ -93,6 +154,15 @@ func (hs *headersSuplier) RoundTrip(req *http.Request) (resp *http.Response, err
 	return
 }
 
+// hostBucket returns bucket addressed by virtual-hosted style host e.g.
+// "bucket.s3.example.com", empty if host carries no bucket
+func hostBucket(host string) string {
+	if !strings.Contains(host, ".s3.") {
+		return ""
+	}
+	return strings.Split(host, ".s3.")[0]
+}
+
 // HeadersSuplier creates Decorator which adds headers to request and response
 func HeadersSuplier(requestHeaders, responseHeaders map[string]string) Decorator {
 	return func(roundTripper http.RoundTripper) http.RoundTripper {
@@ -103,6 +173,171 @@ func HeadersSuplier(requestHeaders, responseHeaders map[string]string) Decorator
 	}
 }
 
+type forwardedHeaders struct {
+	roundTripper http.RoundTripper
+}
+
+func (fh forwardedHeaders) RoundTrip(req *http.Request) (*http.Response, error) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	return fh.roundTripper.RoundTrip(req)
+}
+
+// ForwardedHeaders sets X-Forwarded-Proto and X-Forwarded-Host request headers
+// to scheme and host client connected with. It has to wrap decorators
+// rewriting request host
+func ForwardedHeaders(roundTripper http.RoundTripper) http.RoundTripper {
+	return forwardedHeaders{roundTripper: roundTripper}
+}
+
+// backendHeaderName is response header naming backend which response was
+// passed to client
+const backendHeaderName = "X-Akubra-Backend"
+
+type backendHeader struct {
+	roundTripper http.RoundTripper
+}
+
+func (bh backendHeader) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := bh.roundTripper.RoundTrip(req)
+	if err == nil && resp.Request != nil {
+		resp.Header.Set(backendHeaderName, resp.Request.URL.Host)
+	}
+	return resp, err
+}
+
+// BackendHeader sets X-Akubra-Backend response header to host of backend
+// which response is passed to client. It has to be wrapped by decorators
+// responding without contacting backends
+func BackendHeader(roundTripper http.RoundTripper) http.RoundTripper {
+	return backendHeader{roundTripper: roundTripper}
+}
+
+type queryParamsFilter struct {
+	rejected     []string
+	roundTripper http.RoundTripper
+}
+
+func (qpf queryParamsFilter) RoundTrip(req *http.Request) (*http.Response, error) {
+	query := req.URL.Query()
+	for _, param := range qpf.rejected {
+		if _, ok := query[param]; ok {
+			msg := fmt.Sprintf("Query parameter %q is not supported", param)
+			return newErrorResponse(req, http.StatusNotImplemented, msg), nil
+		}
+	}
+	return qpf.roundTripper.RoundTrip(req)
+}
+
+// QueryParamsFilter creates Decorator which rejects requests containing any
+// of given query parameters with 501 status, e.g. "select" for S3
+// SelectObjectContent which can't be proxied correctly
+func QueryParamsFilter(rejected []string) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		return queryParamsFilter{rejected: rejected, roundTripper: roundTripper}
+	}
+}
+
+type responseHeaderLimit struct {
+	maxValueBytes int
+	truncate      bool
+	logger        *log.Logger
+	roundTripper  http.RoundTripper
+}
+
+func (rhl responseHeaderLimit) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rhl.roundTripper.RoundTrip(req)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+	for name, values := range resp.Header {
+		for i, value := range values {
+			if len(value) <= rhl.maxValueBytes {
+				continue
+			}
+			if rhl.truncate {
+				rhl.logger.Printf("Truncated %q response header of %s %s from %d bytes",
+					name, req.Method, req.URL.Path, len(value))
+				values[i] = value[:rhl.maxValueBytes]
+				continue
+			}
+			rhl.logger.Printf("Rejected response of %s %s, %q header has %d bytes",
+				req.Method, req.URL.Path, name, len(value))
+			if closeErr := resp.Body.Close(); closeErr != nil {
+				rhl.logger.Printf("Cannot close response body reason: %q", closeErr.Error())
+			}
+			msg := fmt.Sprintf("Backend response header %q is too large", name)
+			return newErrorResponse(req, http.StatusBadGateway, msg), nil
+		}
+	}
+	return resp, nil
+}
+
+// ResponseHeaderLimit creates Decorator which limits size of each response
+// header value to maxValueBytes. Larger values are truncated if truncate is
+// set, otherwise response is replaced with 502 Bad Gateway
+func ResponseHeaderLimit(maxValueBytes int, truncate bool, logger *log.Logger) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		return responseHeaderLimit{
+			maxValueBytes: maxValueBytes,
+			truncate:      truncate,
+			logger:        logger,
+			roundTripper:  roundTripper}
+	}
+}
+
+type clockSkewDetector struct {
+	threshold    time.Duration
+	logger       *log.Logger
+	roundTripper http.RoundTripper
+	mx           sync.Mutex
+	// hosts of backends which clock is skewed
+	skewed map[string]bool
+}
+
+func (csd *clockSkewDetector) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := csd.roundTripper.RoundTrip(req)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+	date, dateErr := http.ParseTime(resp.Header.Get("Date"))
+	if dateErr != nil {
+		return resp, err
+	}
+	skew := date.Sub(time.Now())
+	isSkewed := skew > csd.threshold || -skew > csd.threshold
+
+	csd.mx.Lock()
+	defer csd.mx.Unlock()
+	host := req.URL.Host
+	// log only changes, so skewed backend doesn't flood log
+	switch {
+	case isSkewed && !csd.skewed[host]:
+		csd.logger.Printf("WARNING: backend %s clock is skewed by %s", host, skew)
+	case !isSkewed && csd.skewed[host]:
+		csd.logger.Printf("Backend %s clock is no longer skewed", host)
+	}
+	csd.skewed[host] = isSkewed
+	return resp, err
+}
+
+// ClockSkewDetector creates Decorator which compares backend response Date
+// header with local time and logs backends which clock differs more than
+// threshold
+func ClockSkewDetector(threshold time.Duration, logger *log.Logger) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		return &clockSkewDetector{
+			threshold:    threshold,
+			logger:       logger,
+			roundTripper: roundTripper,
+			skewed:       make(map[string]bool)}
+	}
+}
+
 type optionsHandler struct {
 	roundTripper http.RoundTripper
 }
@@ -127,6 +362,38 @@ func OptionsHandler(roundTripper http.RoundTripper) http.RoundTripper {
 	return optionsHandler{roundTripper: roundTripper}
 }
 
+// allowedMethods are request methods akubra passes to backends
+const allowedMethods = "GET, HEAD, PUT, POST, DELETE, OPTIONS"
+
+type localOptionsResponder struct {
+	roundTripper http.RoundTripper
+}
+
+func (lor localOptionsResponder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "OPTIONS" {
+		return lor.roundTripper.RoundTrip(req)
+	}
+	resp := newLocalResponse(req, http.StatusOK, "")
+	resp.Header.Set("Allow", allowedMethods)
+	return resp, nil
+}
+
+// LocalOptionsResponder responds to OPTIONS requests with list of allowed
+// methods, request is not passed to decorated http.RoundTripper
+func LocalOptionsResponder(roundTripper http.RoundTripper) http.RoundTripper {
+	return localOptionsResponder{roundTripper: roundTripper}
+}
+
+// corsConfigured checks if headers contain any CORS header
+func corsConfigured(headers map[string]string) bool {
+	for k := range headers {
+		if strings.HasPrefix(http.CanonicalHeaderKey(k), "Access-Control-") {
+			return true
+		}
+	}
+	return false
+}
+
 // Decorate returns http.Roundtripper wraped with all passed decorators
 func Decorate(roundTripper http.RoundTripper, decorators ...Decorator) http.RoundTripper {
 
@@ -2,16 +2,25 @@ package httphandler
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
-	// "net/url"
-	"encoding/json"
+	"time"
 
+	"github.com/allegro/akubra/transport"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -107,3 +116,638 @@ func TestAccessLogging(t *testing.T) {
 	}
 	assert.Equal(t, http.StatusOK, amd.StatusCode)
 }
+
+func TestClientIdentity(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	req.RemoteAddr = "10.0.0.1:51234"
+	assert.Equal(t, "10.0.0.1", clientIdentity(req))
+
+	req.Header.Set("Authorization", "AWS AKIAEXAMPLE:c2lnbmF0dXJl")
+	assert.Equal(t, "AKIAEXAMPLE", clientIdentity(req))
+
+	req.Header.Set("Authorization",
+		"AWS4-HMAC-SHA256 Credential=AKIAV4EXAMPLE/20170101/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=abc")
+	assert.Equal(t, "AKIAV4EXAMPLE", clientIdentity(req))
+}
+
+func TestBandwidthQuotaRejectsClientOverQuota(t *testing.T) {
+	srv := mkSimpleServer(t)
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, BandwidthQuota(10, time.Hour, false))
+
+	res := sendReq(t, srv, "PUT", bytes.NewBufferString("more than ten bytes"), rt)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	_, err := io.Copy(ioutil.Discard, res.Body)
+	assert.NoError(t, err)
+
+	res = sendReq(t, srv, "GET", nil, rt)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+}
+
+func TestBandwidthQuotaThrottlesClientOverQuota(t *testing.T) {
+	srv := mkSimpleServer(t)
+	defer srv.Close()
+	window := 100 * time.Millisecond
+	rt := Decorate(http.DefaultTransport, BandwidthQuota(10, window, true))
+
+	res := sendReq(t, srv, "PUT", bytes.NewBufferString("more than ten bytes"), rt)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	start := time.Now()
+	res = sendReq(t, srv, "GET", nil, rt)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.True(t, time.Since(start) >= window/2, "Request should be delayed until window reset")
+}
+
+func TestBandwidthQuotaThrottlingStopsWhenRequestIsCanceled(t *testing.T) {
+	srv := mkSimpleServer(t)
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, BandwidthQuota(10, time.Hour, true))
+	res := sendReq(t, srv, "PUT", bytes.NewBufferString("more than ten bytes"), rt)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	assert.NoError(t, err)
+	start := time.Now()
+	_, err = rt.RoundTrip(req.WithContext(ctx))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second, "Throttled request should end with its context")
+}
+
+func TestBandwidthQuotaCountsChunkedUploads(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.Copy(ioutil.Discard, r.Body)
+		assert.NoError(t, err)
+	}))
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, BandwidthQuota(10, time.Hour, false))
+
+	req, err := http.NewRequest("PUT", srv.URL, ioutil.NopCloser(bytes.NewBufferString("more than ten bytes")))
+	assert.NoError(t, err)
+	req.ContentLength = -1
+	res, err := rt.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	res = sendReq(t, srv, "GET", nil, rt)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+}
+
+func TestBandwidthQuotaForgetsExpiredWindows(t *testing.T) {
+	window := 10 * time.Millisecond
+	bq := BandwidthQuota(10, window, false)(http.DefaultTransport).(*bandwidthQuota)
+	bq.account("first", 5)
+	bq.account("second", 5)
+	time.Sleep(2 * window)
+
+	exceeded, _ := bq.exceeded("third")
+	assert.False(t, exceeded)
+	bq.usageMx.Lock()
+	defer bq.usageMx.Unlock()
+	assert.Len(t, bq.usage, 1, "Usage of clients which didn't send requests in last window should be removed")
+}
+
+func TestLocalOptionsResponder(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, LocalOptionsResponder)
+	res := sendReq(t, srv, "OPTIONS", nil, rt)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, allowedMethods, res.Header.Get("Allow"))
+	assert.Empty(t, res.Header.Get("Content-Type"), "Empty response should not declare content type")
+	assert.Equal(t, int64(0), res.ContentLength)
+	assert.False(t, called, "Backend should not be contacted")
+
+	res = sendReq(t, srv, "GET", nil, rt)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.True(t, called, "Other methods should be passed to backend")
+}
+
+func TestCorsConfigured(t *testing.T) {
+	assert.False(t, corsConfigured(map[string]string{"Cache-Control": "public"}))
+	assert.True(t, corsConfigured(map[string]string{"access-control-allow-origin": "*"}))
+}
+
+func mkGzipServer(t *testing.T, content []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gzw := gzip.NewWriter(w)
+		_, err := gzw.Write(content)
+		assert.NoError(t, err)
+		assert.NoError(t, gzw.Close())
+	}))
+}
+
+func TestGzipRequesterDecompressesOnlyRequestedReads(t *testing.T) {
+	content := []byte("plain object content")
+	srv := mkGzipServer(t, content)
+	defer srv.Close()
+	rt := Decorate(&http.Transport{DisableCompression: true}, GzipRequester)
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	res, err := rt.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "Should relay gzip to accepting client")
+		assert.NoError(t, res.Body.Close())
+	}
+
+	req, _ = http.NewRequest("HEAD", srv.URL, nil)
+	res, err = rt.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "HEAD response should not be changed")
+		assert.NoError(t, res.Body.Close())
+	}
+
+	for _, status := range []int{http.StatusNoContent, http.StatusNotModified, http.StatusNotFound} {
+		status := status
+		statusSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(status)
+		}))
+		req, _ = http.NewRequest("GET", statusSrv.URL, nil)
+		res, err = rt.RoundTrip(req)
+		if assert.NoError(t, err, "status %d", status) {
+			assert.Equal(t, status, res.StatusCode)
+			assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "status %d", status)
+			assert.NoError(t, res.Body.Close())
+		}
+		statusSrv.Close()
+	}
+}
+
+func TestGzipRequester(t *testing.T) {
+	content := []byte("plain object content")
+	var received []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("Accept-Encoding"))
+		if !acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+			_, err := w.Write(content)
+			assert.NoError(t, err)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gzw := gzip.NewWriter(w)
+		_, err := gzw.Write(content)
+		assert.NoError(t, err)
+		assert.NoError(t, gzw.Close())
+	}))
+	defer srv.Close()
+	rt := Decorate(&http.Transport{DisableCompression: true}, GzipRequester)
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	res, err := rt.RoundTrip(req)
+	if assert.NoError(t, err) {
+		body, rerr := ioutil.ReadAll(res.Body)
+		assert.NoError(t, rerr)
+		assert.Equal(t, content, body)
+		assert.Empty(t, res.Header.Get("Content-Encoding"))
+	}
+	assert.Equal(t, "identity", req.Header.Get("Accept-Encoding"), "Client header should be restored")
+
+	req, _ = http.NewRequest("PUT", srv.URL, nil)
+	_, err = rt.RoundTrip(req)
+	assert.NoError(t, err)
+
+	req, _ = http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Range", "bytes=0-4")
+	_, err = rt.RoundTrip(req)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"gzip", "", ""}, received)
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	assert.True(t, acceptsEncoding("gzip, deflate", "gzip"))
+	assert.True(t, acceptsEncoding("*", "gzip"))
+	assert.True(t, acceptsEncoding("x-gzip", "gzip"))
+	assert.False(t, acceptsEncoding("", "gzip"))
+	assert.False(t, acceptsEncoding("identity", "gzip"))
+	assert.False(t, acceptsEncoding("gzip;q=0", "gzip"))
+}
+
+func TestAdmissionControl(t *testing.T) {
+	srv := mkSimpleServer(t)
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, AdmissionControl(2, 4))
+	ac := rt.(*admissionControl)
+	ac.random = func() float64 { return 0.5 }
+
+	res := sendReq(t, srv, "GET", nil, rt)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, int64(1), ac.inFlight, "Request is in flight until body is closed")
+	assert.NoError(t, res.Body.Close())
+	assert.Equal(t, int64(0), ac.inFlight)
+
+	// simulate high load
+	ac.inFlight = 4
+	res = sendReq(t, srv, "GET", nil, rt)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, "1", res.Header.Get("Retry-After"))
+
+	assert.True(t, ac.admit(1))
+	assert.True(t, ac.admit(2), "One third of requests should be rejected")
+	assert.False(t, ac.admit(3), "Two thirds of requests should be rejected")
+	assert.False(t, ac.admit(4))
+}
+
+// blockingRoundTripper counts concurrent requests and responds once
+// unblocked
+type blockingRoundTripper struct {
+	inFlight, maxInFlight int64
+	unblock               chan struct{}
+}
+
+func (brt *blockingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := atomic.AddInt64(&brt.inFlight, 1)
+	defer atomic.AddInt64(&brt.inFlight, -1)
+	for {
+		max := atomic.LoadInt64(&brt.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt64(&brt.maxInFlight, max, n) {
+			break
+		}
+	}
+	<-brt.unblock
+	return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+}
+
+func TestAdmissionControlHardLimitUnderConcurrency(t *testing.T) {
+	backend := &blockingRoundTripper{unblock: make(chan struct{})}
+	rt := Decorate(backend, AdmissionControl(1, 4))
+	// widen window between reading and updating in flight counter
+	rt.(*admissionControl).random = func() float64 {
+		time.Sleep(time.Millisecond)
+		return 1
+	}
+	responses := make(chan *http.Response, 100)
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			req := httptest.NewRequest("GET", "http://example.com/bucket/object", nil)
+			res, err := rt.RoundTrip(req)
+			assert.NoError(t, err)
+			responses <- res
+		}()
+	}
+	close(start)
+	// let admitted requests reach backend
+	time.Sleep(50 * time.Millisecond)
+	close(backend.unblock)
+	wg.Wait()
+	close(responses)
+	for res := range responses {
+		assert.NoError(t, res.Body.Close())
+	}
+
+	assert.True(t, atomic.LoadInt64(&backend.maxInFlight) <= 4,
+		"Hard limit exceeded, %d requests in flight", atomic.LoadInt64(&backend.maxInFlight))
+}
+
+func readHeadersEcho(t *testing.T, res *http.Response) map[string][]string {
+	receivedReqHeadersMap := make(map[string][]string)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(body, &receivedReqHeadersMap))
+	return receivedReqHeadersMap
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	srv := mkSimpleServer(t)
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, ForwardedHeaders)
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Host = "bucket.s3.example.com"
+	res, err := rt.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assertIncludeHeaders(t, readHeadersEcho(t, res), map[string]string{
+			"X-Forwarded-Proto": "http",
+			"X-Forwarded-Host":  "bucket.s3.example.com"})
+	}
+
+	req, _ = http.NewRequest("GET", srv.URL, nil)
+	req.TLS = &tls.ConnectionState{}
+	res, err = rt.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assertIncludeHeaders(t, readHeadersEcho(t, res), map[string]string{
+			"X-Forwarded-Proto": "https"})
+	}
+}
+
+func TestQueryParamsFilter(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, QueryParamsFilter([]string{"select"}))
+
+	req, _ := http.NewRequest("POST", srv.URL+"/bucket/object?select&select-type=2", nil)
+	res, err := rt.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusNotImplemented, res.StatusCode)
+	}
+	assert.False(t, called, "Backend should not be contacted")
+
+	req, _ = http.NewRequest("GET", srv.URL+"/bucket?prefix=select", nil)
+	res, err = rt.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	assert.True(t, called)
+}
+
+func TestAccessLoggingVerbosity(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+	verbosity := map[string]string{
+		"VERBOSEKEY": AccessLogVerbose,
+		"QUIETKEY":   AccessLogQuiet,
+	}
+	rt := Decorate(http.DefaultTransport, AccessLoggingWithVerbosity(logger, verbosity))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte("OK"))
+		assert.Nil(t, err)
+	}))
+	defer srv.Close()
+
+	logFields := func(accessKey string) map[string]interface{} {
+		buf.Reset()
+		req, _ := http.NewRequest("GET", srv.URL+"/bucket/key?acl", nil)
+		req.Header.Set("Authorization", "AWS "+accessKey+":signature")
+		_, err := rt.RoundTrip(req)
+		assert.NoError(t, err)
+		fields := make(map[string]interface{})
+		assert.NoError(t, json.Unmarshal(bytes.Trim(buf.Bytes(), "\n"), &fields))
+		return fields
+	}
+
+	verbose := logFields("VERBOSEKEY")
+	normal := logFields("OTHERKEY")
+	quiet := logFields("QUIETKEY")
+	assert.True(t, len(verbose) > len(normal))
+	assert.True(t, len(normal) > len(quiet))
+	assert.Equal(t, "acl", verbose["query"])
+	assert.NotContains(t, fmt.Sprint(verbose["headers"]), "signature", "Credentials should be redacted")
+	assert.Contains(t, quiet, "status")
+}
+
+func TestResponseHeaderLimit(t *testing.T) {
+	oversized := strings.Repeat("a", 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Meta-Big", oversized)
+		w.Header().Set("X-Amz-Meta-Small", "ok")
+	}))
+	defer srv.Close()
+	logger := log.New(ioutil.Discard, "", 0)
+
+	rt := Decorate(http.DefaultTransport, ResponseHeaderLimit(10, true, logger))
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	res, err := rt.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, oversized[:10], res.Header.Get("X-Amz-Meta-Big"))
+	assert.Equal(t, "ok", res.Header.Get("X-Amz-Meta-Small"))
+
+	rt = Decorate(http.DefaultTransport, ResponseHeaderLimit(10, false, logger))
+	req, _ = http.NewRequest("GET", srv.URL, nil)
+	res, err = rt.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, res.StatusCode)
+	assert.Empty(t, res.Header.Get("X-Amz-Meta-Big"))
+}
+
+func TestClockSkewDetector(t *testing.T) {
+	skew := time.Hour
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(skew).UTC().Format(http.TimeFormat))
+	}))
+	defer srv.Close()
+	logged := &bytes.Buffer{}
+	rt := Decorate(http.DefaultTransport, ClockSkewDetector(30*time.Second, log.New(logged, "", 0)))
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		_, err := rt.RoundTrip(req)
+		assert.NoError(t, err)
+	}
+	assert.Contains(t, logged.String(), "clock is skewed")
+	assert.Equal(t, 1, strings.Count(logged.String(), "\n"), "Skew should be logged once")
+
+	skew = 0
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	_, err := rt.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Contains(t, logged.String(), "no longer skewed")
+}
+
+func TestReadOnlyModeWhenBackendsUnhealthy(t *testing.T) {
+	srv := mkSimpleServer(t)
+	defer srv.Close()
+	var healthStatus int32 = http.StatusOK
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&healthStatus)))
+	}))
+	defer backend.Close()
+	healthyBackend := mkSimpleServer(t)
+	defer healthyBackend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	healthyBackendURL, _ := url.Parse(healthyBackend.URL)
+	hc := transport.NewHealthChecker(nil, []*url.URL{backendURL, healthyBackendURL}, "/health", time.Hour, 1)
+	rt := Decorate(http.DefaultTransport, ReadOnlyMode(hc, 2, log.New(ioutil.Discard, "", 0)))
+
+	assertStatuses := func(msg string, readStatus, writeStatus int) {
+		res := sendReq(t, srv, "GET", nil, rt)
+		assert.Equal(t, readStatus, res.StatusCode, msg)
+		assert.NoError(t, res.Body.Close())
+		res = sendReq(t, srv, "PUT", bytes.NewBufferString("content"), rt)
+		assert.Equal(t, writeStatus, res.StatusCode, msg)
+		assert.NoError(t, res.Body.Close())
+	}
+
+	hc.CheckNow()
+	assertStatuses("All backends healthy", http.StatusOK, http.StatusOK)
+
+	atomic.StoreInt32(&healthStatus, http.StatusInternalServerError)
+	hc.CheckNow()
+	assertStatuses("Backend unhealthy", http.StatusOK, http.StatusServiceUnavailable)
+
+	atomic.StoreInt32(&healthStatus, http.StatusOK)
+	hc.CheckNow()
+	assertStatuses("Backend recovered", http.StatusOK, http.StatusOK)
+}
+
+func TestAccessLoggingFormats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte("created"))
+		assert.Nil(t, err)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	rt := Decorate(http.DefaultTransport, AccessLoggingWithFormat(logger, nil, AccessLogJSON))
+	res := sendReq(t, srv, "PUT", bytes.NewBufferString("content"), rt)
+	assert.NoError(t, res.Body.Close())
+	fields := make(map[string]interface{})
+	if !assert.NoError(t, json.Unmarshal(bytes.Trim(buf.Bytes(), "\n"), &fields)) {
+		return
+	}
+	assert.Equal(t, "PUT", fields["method"])
+	assert.Contains(t, fields, "path")
+	assert.Equal(t, float64(http.StatusCreated), fields["status"])
+	assert.Equal(t, srvURL.Host, fields["backend"])
+	assert.Equal(t, float64(len("created")), fields["bytes"])
+	assert.Contains(t, fields, "duration")
+
+	for _, level := range []string{AccessLogQuiet, AccessLogNormal, AccessLogVerbose} {
+		buf.Reset()
+		// request has no client address nor credentials
+		verbosity := map[string]string{"": level}
+		rt = Decorate(http.DefaultTransport, AccessLoggingWithFormat(logger, verbosity, AccessLogText))
+		res = sendReq(t, srv, "PUT", bytes.NewBufferString("content"), rt)
+		assert.NoError(t, res.Body.Close())
+		amd, err := ScanCSVAccessLogMessage(buf.String())
+		assert.NoError(t, err, "Text message of %s level should be parsed", level)
+		assert.Equal(t, "PUT", amd.Method)
+		assert.Equal(t, http.StatusCreated, amd.StatusCode)
+		assert.Equal(t, srvURL.Host, amd.Backend)
+		assert.Equal(t, int64(len("created")), amd.Bytes)
+	}
+}
+
+func TestBackendHeaderAndAccessLogNameSameBackend(t *testing.T) {
+	srv := mkSimpleServer(t)
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	var buf bytes.Buffer
+	rt := Decorate(http.DefaultTransport, BackendHeader, AccessLogging(log.New(&buf, "", 0)))
+
+	res := sendReq(t, srv, "GET", nil, rt)
+	assert.NoError(t, res.Body.Close())
+
+	assert.Equal(t, srvURL.Host, res.Header.Get("X-Akubra-Backend"))
+	amd := &AccessMessageData{}
+	assert.NoError(t, json.Unmarshal(bytes.Trim(buf.Bytes(), "\n"), amd))
+	assert.Equal(t, srvURL.Host, amd.Backend)
+}
+
+func TestSlowDownIsRelayedAndThrottlesClient(t *testing.T) {
+	var backendRequests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backendRequests, 1)
+		if r.Header.Get("Authorization") != "AWS SLOWKEY:signature" {
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, err := w.Write([]byte(slowDownBody))
+		assert.NoError(t, err)
+	}))
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, SlowDownThrottle(200*time.Millisecond))
+	send := func(accessKey string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", srv.URL+"/bucket/key", nil)
+		req.Header.Set("Authorization", "AWS "+accessKey+":signature")
+		res, err := rt.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, res.Body.Close())
+		return res, string(body)
+	}
+
+	res, body := send("SLOWKEY")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, slowDownBody, body, "Backend SlowDown should be relayed unchanged")
+
+	res, body = send("SLOWKEY")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Contains(t, body, "<Code>SlowDown</Code>")
+	assert.Equal(t, "1", res.Header.Get("Retry-After"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&backendRequests), "Throttled client should not reach backend")
+
+	res, _ = send("OTHERKEY")
+	assert.Equal(t, http.StatusOK, res.StatusCode, "Other clients should not be throttled")
+
+	time.Sleep(200 * time.Millisecond)
+	send("SLOWKEY")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&backendRequests), "Client should reach backend after cooldown")
+}
+
+func TestSlowDownThrottleForgetsExpiredClients(t *testing.T) {
+	cooldown := 10 * time.Millisecond
+	sdt := SlowDownThrottle(cooldown)(http.DefaultTransport).(*slowDownThrottle)
+	sdt.throttle("first")
+	sdt.throttle("second")
+	time.Sleep(2 * cooldown)
+
+	sdt.throttle("third")
+	sdt.throttledMx.Lock()
+	defer sdt.throttledMx.Unlock()
+	assert.Len(t, sdt.throttledUntil, 1, "Clients which didn't come back after cooldown should be removed")
+}
+
+func TestPresignedCredentialsAreRedacted(t *testing.T) {
+	var buf bytes.Buffer
+	rt := Decorate(http.DefaultTransport,
+		AccessLoggingWithVerbosity(log.New(&buf, "", 0), map[string]string{"127.0.0.1": AccessLogVerbose}))
+	srv := mkSimpleServer(t)
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"/bucket/key?X-Amz-Algorithm=AWS4-HMAC-SHA256"+
+		"&X-Amz-Credential=AKIAPRESIGNED%2F20170101%2Fus-east-1%2Fs3%2Faws4_request"+
+		"&X-Amz-Security-Token=c2Vzc2lvbiB0b2tlbg%3D%3D&X-Amz-Signature=c2lnbmF0dXJl"+
+		"&AWSAccessKeyId=AKIAV2&Signature=djJzaWduYXR1cmU%3D&versionId=3", nil)
+	req.RemoteAddr = "127.0.0.1:51234"
+	req.Header.Set("X-Amz-Security-Token", "aGVhZGVyIHRva2Vu")
+
+	res, err := rt.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, res.Body.Close())
+	for _, secret := range []string{"AKIAPRESIGNED", "c2Vzc2lvbiB0b2tlbg", "c2lnbmF0dXJl", "djJzaWduYXR1cmU", "aGVhZGVyIHRva2Vu"} {
+		assert.NotContains(t, buf.String(), secret)
+	}
+	assert.Contains(t, buf.String(), "X-Amz-Signature=REDACTED")
+	assert.Contains(t, buf.String(), "versionId=3", "Other parameters should be logged")
+}
+
+func TestSSECustomerKeyIsRedacted(t *testing.T) {
+	var buf bytes.Buffer
+	rt := Decorate(http.DefaultTransport,
+		AccessLoggingWithVerbosity(log.New(&buf, "", 0), map[string]string{"SSEKEY": AccessLogVerbose}))
+	srv := mkSimpleServer(t)
+	defer srv.Close()
+	req, _ := http.NewRequest("PUT", srv.URL+"/bucket/key", bytes.NewBufferString("content"))
+	req.Header.Set("Authorization", "AWS SSEKEY:signature")
+	req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+	req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key", "c2VjcmV0IGtleQ==")
+	req.Header.Set("X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key", "c291cmNlIGtleQ==")
+
+	res, err := rt.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	receivedHeaders := readHeadersEcho(t, res)
+	assert.Equal(t, []string{"c2VjcmV0IGtleQ=="}, receivedHeaders["X-Amz-Server-Side-Encryption-Customer-Key"],
+		"Key should reach backend")
+	assert.NotContains(t, buf.String(), "c2VjcmV0IGtleQ==")
+	assert.NotContains(t, buf.String(), "c291cmNlIGtleQ==")
+	assert.Contains(t, buf.String(), "AES256")
+}
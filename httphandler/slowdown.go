@@ -0,0 +1,103 @@
+package httphandler
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// slowDownPeekSize is number of 503 response body bytes searched for
+// SlowDown error code
+const slowDownPeekSize = 1024
+
+// slowDownBody is S3 error returned to throttled clients
+const slowDownBody = `<?xml version="1.0" encoding="UTF-8"?>` +
+	"<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>"
+
+type slowDownThrottle struct {
+	cooldown time.Duration
+	// time until which requests of client are rejected, keyed by client
+	throttledUntil map[string]time.Time
+	throttledMx    sync.Mutex
+	// expired entries are removed from throttledUntil once per cooldown
+	lastSweep    time.Time
+	roundTripper http.RoundTripper
+}
+
+// throttled returns time left until client may send requests again
+func (sdt *slowDownThrottle) throttled(client string) time.Duration {
+	sdt.throttledMx.Lock()
+	defer sdt.throttledMx.Unlock()
+	until, ok := sdt.throttledUntil[client]
+	if !ok {
+		return 0
+	}
+	left := time.Until(until)
+	if left <= 0 {
+		delete(sdt.throttledUntil, client)
+		return 0
+	}
+	return left
+}
+
+func (sdt *slowDownThrottle) throttle(client string) {
+	sdt.throttledMx.Lock()
+	defer sdt.throttledMx.Unlock()
+	now := time.Now()
+	if now.Sub(sdt.lastSweep) >= sdt.cooldown {
+		// clients which didn't come back wouldn't be removed by throttled
+		for c, until := range sdt.throttledUntil {
+			if !now.Before(until) {
+				delete(sdt.throttledUntil, c)
+			}
+		}
+		sdt.lastSweep = now
+	}
+	sdt.throttledUntil[client] = now.Add(sdt.cooldown)
+}
+
+// isSlowDown checks if response is S3 SlowDown error. Beginning of body is
+// read to find error code, so it is replaced with body returning same content
+func isSlowDown(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Body == nil {
+		return false
+	}
+	peek, err := ioutil.ReadAll(io.LimitReader(resp.Body, slowDownPeekSize))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peek), resp.Body), resp.Body}
+	return err == nil && bytes.Contains(peek, []byte("<Code>SlowDown</Code>"))
+}
+
+func (sdt *slowDownThrottle) RoundTrip(req *http.Request) (*http.Response, error) {
+	client := clientIdentity(req)
+	if left := sdt.throttled(client); left > 0 {
+		resp := newErrorResponse(req, http.StatusServiceUnavailable, slowDownBody)
+		resp.Header.Set("Content-Type", "application/xml")
+		resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(left.Seconds()))))
+		return resp, nil
+	}
+	resp, err := sdt.roundTripper.RoundTrip(req)
+	if err == nil && isSlowDown(resp) {
+		sdt.throttle(client)
+	}
+	return resp, err
+}
+
+// SlowDownThrottle creates Decorator which rejects requests of client, which
+// received 503 SlowDown response from backends, with SlowDown error for
+// cooldown. Backend SlowDown responses are passed unchanged
+func SlowDownThrottle(cooldown time.Duration) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		return &slowDownThrottle{
+			cooldown:       cooldown,
+			throttledUntil: make(map[string]time.Time),
+			roundTripper:   roundTripper}
+	}
+}
@@ -0,0 +1,73 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// BackendStatus describes backend state
+type BackendStatus struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+	// Healthy is not set if health checking is disabled
+	Healthy *bool `json:"healthy,omitempty"`
+	// Circuit is not set if circuit breaker is disabled
+	Circuit string `json:"circuit,omitempty"`
+}
+
+// Status describes backends requests are replicated to
+type Status struct {
+	Backends []BackendStatus `json:"backends"`
+	// ReplicatedMethods is empty if all methods are replicated
+	ReplicatedMethods []string `json:"replicatedmethods,omitempty"`
+}
+
+// Status returns current state of backends
+func (h *Handler) Status() Status {
+	mt := h.multiTransport
+	status := Status{Backends: make([]BackendStatus, 0, len(mt.Backends))}
+	var health map[string]bool
+	if mt.HealthChecker != nil {
+		health = mt.HealthChecker.State()
+	}
+	var circuits map[string]string
+	if mt.CircuitBreaker != nil {
+		circuits = mt.CircuitBreaker.State()
+	}
+	for _, backend := range mt.Backends {
+		backendStatus := BackendStatus{URL: backend.String(), Weight: 1}
+		if weight, ok := mt.Weights[backend.Host]; ok {
+			backendStatus.Weight = weight
+		}
+		if health != nil {
+			healthy := health[backend.Host]
+			backendStatus.Healthy = &healthy
+		}
+		if circuits != nil {
+			backendStatus.Circuit = "closed"
+			if state, ok := circuits[backend.Host]; ok {
+				backendStatus.Circuit = state
+			}
+		}
+		status.Backends = append(status.Backends, backendStatus)
+	}
+	for method := range mt.ReplicatedMethods {
+		status.ReplicatedMethods = append(status.ReplicatedMethods, method)
+	}
+	sort.Strings(status.ReplicatedMethods)
+	return status
+}
+
+// ServeStatus responds with Status encoded as JSON
+func (h *Handler) ServeStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.Status()); err != nil {
+		h.mainLog.Printf("Cannot send status reason: %q", err.Error())
+	}
+}
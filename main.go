@@ -5,6 +5,11 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kingpin"
@@ -41,8 +46,23 @@ func main() {
 	mainlog := conf.Mainlog
 	mainlog.Printf("starting on port %s", conf.Listen)
 	mainlog.Printf("connlimit %v", conf.ConnLimit)
+	perBackend, clientRequests := conf.EffectiveConnLimits()
+	mainlog.Printf("effective connlimit per backend %v, concurrent client requests %v",
+		perBackend, clientRequests)
+	for _, warning := range conf.ConnLimitWarnings() {
+		mainlog.Printf("WARNING: %s", warning)
+	}
+	for _, duplicate := range conf.DuplicateBackends() {
+		mainlog.Printf("WARNING: backend %s is listed more than once, requests are replicated to it multiple times",
+			duplicate)
+	}
+	if conf.BackendTLS.InsecureSkipVerify {
+		mainlog.Printf("WARNING: backend certificates are not verified (BackendTLS.InsecureSkipVerify), " +
+			"don't use it in production")
+	}
 	mainlog.Printf("backends %s", conf.Backends)
 	srv := newService(conf)
+	srv.configPath = *configFile
 	startErr := srv.start()
 	if startErr != nil {
 		mainlog.Printf("Could not start service, reason: %q", startErr.Error())
@@ -51,28 +71,202 @@ func main() {
 
 type service struct {
 	config config.Config
+	// configuration is reloaded from this file on SIGHUP
+	configPath string
+	// loads configuration from configPath
+	configure func(configPath string) (config.Config, error)
+	// serializes reloads, so configuration is never applied partially
+	reloadMx sync.Mutex
+	handler  *reloadableHandler
+	// handlers replaced by reload which still finish requests
+	retired sync.WaitGroup
 }
 
-func (s *service) start() error {
-	handler := httphandler.NewHandler(s.config)
+// reloadableHandler passes requests to handler which may be replaced while
+// serving. In flight requests are finished by handler they started with
+type reloadableHandler struct {
+	handler atomic.Value
+}
+
+func newReloadableHandler(handler http.Handler) *reloadableHandler {
+	rh := &reloadableHandler{}
+	rh.handler.Store(&handler)
+	return rh
+}
+
+func (rh *reloadableHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rh.current().ServeHTTP(w, req)
+}
+
+// current returns handler requests are currently passed to
+func (rh *reloadableHandler) current() http.Handler {
+	return *rh.handler.Load().(*http.Handler)
+}
+
+// swap replaces handler and returns previous one
+func (rh *reloadableHandler) swap(handler http.Handler) http.Handler {
+	previous := rh.handler.Load().(*http.Handler)
+	rh.handler.Store(&handler)
+	return *previous
+}
+
+// reload reads configuration file and replaces handler with one built from
+// it. Invalid configuration is logged and current handler is kept
+func (s *service) reload() {
+	s.reloadMx.Lock()
+	defer s.reloadMx.Unlock()
+	mainlog := s.config.Mainlog
+	conf, err := s.configure(s.configPath)
+	if err != nil {
+		mainlog.Printf("Configuration not reloaded: %s", err)
+		return
+	}
+	if conf.Listen != s.config.Listen {
+		mainlog.Printf("WARNING: Listen change requires restart, still listening on %s", s.config.Listen)
+	}
+	previousConf := s.config
+	s.config = conf
+	previous := s.handler.swap(httphandler.NewHandler(conf))
+	if closer, ok := previous.(interface {
+		Close()
+	}); ok {
+		closer.Close()
+	}
+	s.retired.Add(1)
+	go func() {
+		defer s.retired.Done()
+		// log files no longer used are closed once nothing writes to them
+		if handler, ok := previous.(*httphandler.Handler); ok {
+			handler.WaitForWrites(drainTimeout(previousConf))
+		}
+		if err := previousConf.CloseUnusedLogs(conf); err != nil {
+			conf.Mainlog.Printf("Cannot close logs: %s", err)
+		}
+	}()
+	conf.Mainlog.Printf("Configuration reloaded, backends %s", conf.Backends)
+}
+
+// reloadOnSignal reloads configuration on SIGHUP. Signals received during
+// reload are coalesced into single following reload
+func (s *service) reloadOnSignal() {
+	// signals which don't fit in buffer are dropped
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			s.reload()
+		}
+	}()
+}
+
+func (s *service) newServer(handler http.Handler) *graceful.Server {
+	readHeaderTimeout, _ := time.ParseDuration(s.config.ReadHeaderTimeout)
 	srv := &graceful.Server{
 		Server: &http.Server{
-			Addr:    s.config.Listen,
-			Handler: handler,
+			Addr:              s.config.Listen,
+			Handler:           handler,
+			ReadHeaderTimeout: readHeaderTimeout,
 		},
 		Timeout: 10 * time.Second,
 	}
 
 	srv.SetKeepAlivesEnabled(true)
+	return srv
+}
+
+// defaultWritesDrainTimeout is used if WritesDrainTimeout is not configured
+const defaultWritesDrainTimeout = 10 * time.Second
+
+// drainTimeout returns how long writes are waited for
+func drainTimeout(conf config.Config) time.Duration {
+	if conf.WritesDrainTimeout == "" {
+		return defaultWritesDrainTimeout
+	}
+	timeout, _ := time.ParseDuration(conf.WritesDrainTimeout)
+	return timeout
+}
+
+// drainWrites waits until writes in flight, also ones of handlers replaced
+// by reload, are replicated to all backends, so shutdown doesn't leave
+// backends out of sync
+func (s *service) drainWrites() {
+	s.reloadMx.Lock()
+	defer s.reloadMx.Unlock()
+	timeout := drainTimeout(s.config)
+	deadline := time.Now().Add(timeout)
+	drained := true
+	if handler, ok := s.handler.current().(*httphandler.Handler); ok {
+		drained = handler.WaitForWrites(timeout)
+	}
+	retired := make(chan struct{})
+	go func() {
+		s.retired.Wait()
+		close(retired)
+	}()
+	select {
+	case <-retired:
+	case <-time.After(time.Until(deadline)):
+		drained = false
+	}
+	if !drained {
+		s.config.Mainlog.Printf("WARNING: writes not replicated to all backends within %s", timeout)
+	}
+}
+
+// serve accepts connections until server is stopped, then waits for writes
+// replicated in background and closes log files, so compressed sync log is
+// left readable
+func (s *service) serve(srv *graceful.Server, listener net.Listener) error {
+	err := srv.Serve(listener)
+	s.drainWrites()
+	s.reloadMx.Lock()
+	defer s.reloadMx.Unlock()
+	if closeErr := s.config.CloseUnusedLogs(config.Config{}); closeErr != nil {
+		s.config.Mainlog.Printf("Cannot close logs: %s", closeErr)
+	}
+	return err
+}
+
+func (s *service) start() error {
+	s.handler = newReloadableHandler(httphandler.NewHandler(s.config))
+	s.reloadOnSignal()
+	if s.config.AdminListen != "" {
+		go s.startAdmin(s.config.AdminListen, s.config.Mainlog)
+	}
+	srv := s.newServer(s.handler)
 	listener, err := net.Listen("tcp", s.config.Listen)
 
 	if err != nil {
 		panic(err)
 	}
 
-	return srv.Serve(listener)
+	return s.serve(srv, listener)
+}
+
+// adminHandler serves administrative endpoints
+func (s *service) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		handler, ok := s.handler.current().(*httphandler.Handler)
+		if !ok {
+			http.Error(w, "Status not available", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeStatus(w, req)
+	})
+	return mux
+}
+
+func (s *service) startAdmin(addr string, mainlog *log.Logger) {
+	err := http.ListenAndServe(addr, s.adminHandler())
+	mainlog.Printf("Admin server stopped, reason: %q", err.Error())
 }
 
 func newService(cfg config.Config) *service {
-	return &service{config: cfg}
+	s := &service{config: cfg}
+	// reload reuses log files of current configuration
+	s.configure = func(configPath string) (config.Config, error) {
+		return config.Reconfigure(configPath, s.config)
+	}
+	return s
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/httphandler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowHeadersConnectionIsClosed(t *testing.T) {
+	conf := config.Config{}
+	conf.ReadHeaderTimeout = "100ms"
+	srv := newService(conf).newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, listener.Close())
+	}()
+	go func() {
+		_ = srv.Server.Serve(listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, conn.Close())
+	}()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n"))
+	assert.NoError(t, err)
+
+	start := time.Now()
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, err = ioutil.ReadAll(conn)
+	assert.NoError(t, err, "Connection should be closed by server")
+	assert.True(t, time.Since(start) < time.Second, "Connection should be closed after ReadHeaderTimeout")
+}
+
+func TestHandlerSwapUnderConcurrentTraffic(t *testing.T) {
+	mkHandler := func(status int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+	}
+	rh := newReloadableHandler(mkHandler(http.StatusOK))
+	srv := httptest.NewServer(rh)
+	defer srv.Close()
+
+	stop := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				close(swapped)
+				return
+			default:
+			}
+			// both handlers respond successfully, but with different status
+			status := http.StatusOK
+			if i%2 == 0 {
+				status = http.StatusNoContent
+			}
+			rh.swap(mkHandler(status))
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				resp, err := http.Get(srv.URL)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.True(t, resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent)
+				assert.NoError(t, resp.Body.Close())
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-swapped
+}
+
+func TestInvalidConfigurationReloadKeepsHandler(t *testing.T) {
+	confFile, err := ioutil.TempFile("", "akubra")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, os.Remove(confFile.Name()))
+	}()
+	_, err = confFile.WriteString("Listen: \":8080\"\nBackends: []\n")
+	assert.NoError(t, err)
+	assert.NoError(t, confFile.Close())
+
+	current := http.NotFoundHandler()
+	s := newService(config.Config{})
+	s.config.Mainlog = log.New(ioutil.Discard, "", 0)
+	s.configPath = confFile.Name()
+	s.handler = newReloadableHandler(current)
+
+	s.reload()
+
+	assert.Equal(t, fmt.Sprintf("%p", current), fmt.Sprintf("%p", s.handler.swap(current)),
+		"Handler should not be replaced with invalid configuration")
+}
+
+func TestConcurrentReloadsAreSerialized(t *testing.T) {
+	discard := log.New(ioutil.Discard, "", 0)
+	var generation int32
+	s := newService(config.Config{})
+	s.config.Mainlog = discard
+	s.handler = newReloadableHandler(http.NotFoundHandler())
+	s.configure = func(string) (config.Config, error) {
+		conf := config.Config{Accesslog: discard, Mainlog: discard, Synclog: discard}
+		backend, err := url.Parse(fmt.Sprintf("http://backend-%d.internal", atomic.AddInt32(&generation, 1)))
+		conf.Backends = []config.YAMLURL{{URL: backend}}
+		return conf, err
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.reload()
+		}()
+	}
+	wg.Wait()
+
+	handler, ok := s.handler.current().(*httphandler.Handler)
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, s.config.Backends[0].String(), handler.Status().Backends[0].URL,
+		"Handler should be built from last applied configuration")
+}
+
+func TestShutdownWaitsForReplicatedWrites(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	var slowCompleted int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		_, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		atomic.StoreInt32(&slowCompleted, 1)
+	}))
+	defer slow.Close()
+	fastURL, _ := url.Parse(fast.URL)
+	slowURL, _ := url.Parse(slow.URL)
+
+	discard := log.New(ioutil.Discard, "", 0)
+	conf := config.Config{Accesslog: discard, Mainlog: discard, Synclog: discard}
+	conf.ConnLimit = 10
+	conf.Backends = []config.YAMLURL{{URL: fastURL}, {URL: slowURL}}
+	s := newService(conf)
+	s.handler = newReloadableHandler(httphandler.NewHandler(conf))
+	srv := s.newServer(s.handler)
+	srv.NoSignalHandling = true
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	served := make(chan error)
+	go func() {
+		served <- s.serve(srv, listener)
+	}()
+
+	req, _ := http.NewRequest("PUT", "http://"+listener.Addr().String()+"/bucket/object",
+		strings.NewReader("content"))
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&slowCompleted), "Client should not wait for slow backend")
+
+	srv.Stop(time.Second)
+	assert.NoError(t, <-served)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slowCompleted), "Shutdown should wait for write to slow backend")
+}
+
+func TestShutdownWaitsForWritesOfReplacedHandler(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	var slowCompleted int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		_, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		atomic.StoreInt32(&slowCompleted, 1)
+	}))
+	defer slow.Close()
+	fastURL, _ := url.Parse(fast.URL)
+	slowURL, _ := url.Parse(slow.URL)
+
+	discard := log.New(ioutil.Discard, "", 0)
+	conf := config.Config{Accesslog: discard, Mainlog: discard, Synclog: discard}
+	conf.ConnLimit = 10
+	conf.Backends = []config.YAMLURL{{URL: fastURL}, {URL: slowURL}}
+	s := newService(conf)
+	s.handler = newReloadableHandler(httphandler.NewHandler(conf))
+	s.configure = func(string) (config.Config, error) {
+		return conf, nil
+	}
+
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, httptest.NewRequest("PUT", "http://example.com/bucket/object", strings.NewReader("content")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	s.reload()
+
+	s.drainWrites()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slowCompleted), "Shutdown should wait for writes of replaced handler")
+}
@@ -0,0 +1,299 @@
+package reconciler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/allegro/akubra/httphandler"
+	"github.com/allegro/akubra/transport"
+)
+
+// Worker replays writes logged in synclog, copying objects from backend
+// which handled write successfully to backend which failed it
+type Worker struct {
+	roundTripper http.RoundTripper
+	// backends keyed by host, entries naming other hosts are not replayed
+	backends    map[string]*url.URL
+	maxAttempts int
+	// delay before second attempt, doubled with each next one
+	backoff time.Duration
+	log     *log.Logger
+	// Credentials keyed by backend host, replays sent to listed backends
+	// are signed with them
+	Credentials map[string]transport.Credentials
+}
+
+// errNotReplayable is returned for entries which can't be replayed, they
+// are not retried
+type errNotReplayable struct {
+	reason string
+}
+
+func (e errNotReplayable) Error() string {
+	return e.reason
+}
+
+// presignParams are query parameters of presigned requests, they don't
+// change object addressed by request
+var presignParams = []string{"AWSAccessKeyId", "Signature", "Expires"}
+
+// isSubresourceQuery checks if query addresses object sub-resource, e.g.
+// version, multipart upload or tagging, instead of whole object
+func isSubresourceQuery(rawQuery string) bool {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return true
+	}
+	for name := range query {
+		if strings.HasPrefix(name, "X-Amz-") {
+			continue
+		}
+		presign := false
+		for _, param := range presignParams {
+			presign = presign || name == param
+		}
+		if !presign {
+			return true
+		}
+	}
+	return false
+}
+
+// entryKey identifies object on backend, entries with same key are
+// replayed once
+func entryKey(entry httphandler.SyncLogMessageData) string {
+	return entry.FailedHost + entry.Host + entry.Path + "?" + entry.Query
+}
+
+// ReadEntries decodes synclog lines from r and passes them to returned
+// channel, which is closed once r is exhausted. Malformed lines are skipped
+func ReadEntries(r io.Reader, errLog *log.Logger) <-chan httphandler.SyncLogMessageData {
+	entries := make(chan httphandler.SyncLogMessageData)
+	go func() {
+		defer close(entries)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			entry := httphandler.SyncLogMessageData{}
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				errLog.Printf("Skipping malformed synclog line %q: %s", scanner.Text(), err)
+				continue
+			}
+			entries <- entry
+		}
+		if err := scanner.Err(); err != nil {
+			errLog.Printf("Cannot read synclog: %s", err)
+		}
+	}()
+	return entries
+}
+
+// Run replays entries until channel is closed. Entries waiting in channel
+// are deduplicated, only last entry for object is replayed
+func (w *Worker) Run(entries <-chan httphandler.SyncLogMessageData) {
+	for entry := range entries {
+		for _, pending := range w.drain(entry, entries) {
+			w.replayWithRetries(pending)
+		}
+	}
+}
+
+// drain returns first and entries immediately available in channel, with
+// each object listed once at position of its first entry
+func (w *Worker) drain(first httphandler.SyncLogMessageData,
+	entries <-chan httphandler.SyncLogMessageData) []httphandler.SyncLogMessageData {
+	batch := []httphandler.SyncLogMessageData{first}
+	positions := map[string]int{entryKey(first): 0}
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				return batch
+			}
+			if i, seen := positions[entryKey(entry)]; seen {
+				batch[i] = entry
+				continue
+			}
+			positions[entryKey(entry)] = len(batch)
+			batch = append(batch, entry)
+		default:
+			return batch
+		}
+	}
+}
+
+func (w *Worker) replayWithRetries(entry httphandler.SyncLogMessageData) {
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		err := w.replay(entry)
+		if err == nil {
+			return
+		}
+		if _, ok := err.(errNotReplayable); ok {
+			w.log.Printf("Skipping %s %s?%s on %s: %s",
+				entry.Method, entry.Path, entry.Query, entry.FailedHost, err)
+			return
+		}
+		if attempt >= w.maxAttempts {
+			w.log.Printf("Cannot replay %s %s on %s, giving up after %d attempts: %s",
+				entry.Method, entry.Path, entry.FailedHost, attempt, err)
+			return
+		}
+		w.log.Printf("Cannot replay %s %s on %s: %s", entry.Method, entry.Path, entry.FailedHost, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// newRequest creates request of entry object on backend with given host.
+// Request carries Host header of logged request and is signed with backend
+// Credentials if there are any
+func (w *Worker) newRequest(method, backendHost string, entry httphandler.SyncLogMessageData,
+	body io.Reader) (*http.Request, error) {
+	backend, ok := w.backends[backendHost]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", backendHost)
+	}
+	target := *backend
+	target.Path = entry.Path
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Host != "" {
+		req.Host = entry.Host
+	}
+	return req, nil
+}
+
+// signRequest signs request to backend with given host if it has Credentials
+func (w *Worker) signRequest(req *http.Request, backendHost string) error {
+	if credentials, ok := w.Credentials[backendHost]; ok {
+		return transport.SignRequest(req, credentials)
+	}
+	return nil
+}
+
+// replay repeats write on failed backend. Writes of object sub-resources
+// are not replayed, copying or deleting whole object would be wrong
+func (w *Worker) replay(entry httphandler.SyncLogMessageData) error {
+	if isSubresourceQuery(entry.Query) {
+		return errNotReplayable{"replaying sub-resource writes is not supported"}
+	}
+	switch entry.Method {
+	case http.MethodPut:
+		return w.copyObject(entry)
+	case http.MethodDelete:
+		return w.deleteObject(entry)
+	}
+	return errNotReplayable{fmt.Sprintf("replaying %s is not supported", entry.Method)}
+}
+
+// copiedHeaders are object headers copied along with its content
+var copiedHeaders = []string{"Content-Type", "Content-Encoding", "Content-Disposition", "Cache-Control"}
+
+func (w *Worker) copyObject(entry httphandler.SyncLogMessageData) error {
+	getReq, err := w.newRequest(http.MethodGet, entry.SuccessHost, entry, nil)
+	if err != nil {
+		return err
+	}
+	if err = w.signRequest(getReq, entry.SuccessHost); err != nil {
+		return err
+	}
+	getResp, err := w.roundTripper.RoundTrip(getReq)
+	if err != nil {
+		return err
+	}
+	defer w.discardBody(getResp)
+	if getResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("source backend %s responded with %s", entry.SuccessHost, getResp.Status)
+	}
+
+	putReq, err := w.newRequest(http.MethodPut, entry.FailedHost, entry, getResp.Body)
+	if err != nil {
+		return err
+	}
+	putReq.ContentLength = getResp.ContentLength
+	for name, values := range getResp.Header {
+		if isCopiedHeader(name) {
+			putReq.Header[name] = values
+		}
+	}
+	if err = w.signRequest(putReq, entry.FailedHost); err != nil {
+		return err
+	}
+	return w.send(putReq)
+}
+
+func isCopiedHeader(name string) bool {
+	if strings.HasPrefix(name, "X-Amz-Meta-") {
+		return true
+	}
+	for _, copied := range copiedHeaders {
+		if name == copied {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Worker) deleteObject(entry httphandler.SyncLogMessageData) error {
+	req, err := w.newRequest(http.MethodDelete, entry.FailedHost, entry, nil)
+	if err != nil {
+		return err
+	}
+	if err = w.signRequest(req, entry.FailedHost); err != nil {
+		return err
+	}
+	return w.send(req)
+}
+
+// send sends request to failed backend, non 2XX status is returned as error
+func (w *Worker) send(req *http.Request) error {
+	resp, err := w.roundTripper.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer w.discardBody(resp)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("backend %s responded with %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+func (w *Worker) discardBody(resp *http.Response) {
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		w.log.Printf("Could not discard body %s", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		w.log.Printf("Could not close body %s", err)
+	}
+}
+
+// NewWorker creates Worker replaying writes on backends with roundTripper.
+// Write is attempted up to maxAttempts times, delay between attempts starts
+// at backoff and is doubled after each failure
+func NewWorker(roundTripper http.RoundTripper, backends []*url.URL, maxAttempts int,
+	backoff time.Duration, errLog *log.Logger) *Worker {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	backendsByHost := make(map[string]*url.URL, len(backends))
+	for _, backend := range backends {
+		backendsByHost[backend.Host] = backend
+	}
+	return &Worker{
+		roundTripper: roundTripper,
+		backends:     backendsByHost,
+		maxAttempts:  maxAttempts,
+		backoff:      backoff,
+		log:          errLog,
+	}
+}
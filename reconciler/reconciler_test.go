@@ -0,0 +1,207 @@
+package reconciler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/allegro/akubra/httphandler"
+	"github.com/allegro/akubra/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+// objectStore is backend keeping objects in memory
+type objectStore struct {
+	objects map[string][]byte
+	headers map[string]http.Header
+	puts    int32
+	// number of requests failed before backend starts responding
+	failures int32
+	// Host and Authorization headers of received requests
+	hosts          []string
+	authorizations []string
+	mx             sync.Mutex
+	t              *testing.T
+}
+
+func (store *objectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.AddInt32(&store.failures, -1) >= 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	store.hosts = append(store.hosts, r.Host)
+	store.authorizations = append(store.authorizations, r.Header.Get("Authorization"))
+	switch r.Method {
+	case http.MethodGet:
+		object, ok := store.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range store.headers[r.URL.Path] {
+			w.Header()[k] = v
+		}
+		_, err := w.Write(object)
+		assert.NoError(store.t, err)
+	case http.MethodPut:
+		atomic.AddInt32(&store.puts, 1)
+		object, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		store.objects[r.URL.Path] = object
+		store.headers[r.URL.Path] = r.Header
+	case http.MethodDelete:
+		delete(store.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func mkObjectStore(t *testing.T) (*objectStore, *httptest.Server, *url.URL) {
+	store := &objectStore{objects: map[string][]byte{}, headers: map[string]http.Header{}, t: t}
+	srv := httptest.NewServer(store)
+	srvURL, _ := url.Parse(srv.URL)
+	return store, srv, srvURL
+}
+
+func mkEntries(entries ...httphandler.SyncLogMessageData) <-chan httphandler.SyncLogMessageData {
+	ch := make(chan httphandler.SyncLogMessageData, len(entries))
+	for _, entry := range entries {
+		ch <- entry
+	}
+	close(ch)
+	return ch
+}
+
+func TestWorkerReplaysWrites(t *testing.T) {
+	source, sourceSrv, sourceURL := mkObjectStore(t)
+	defer sourceSrv.Close()
+	destination, destinationSrv, destinationURL := mkObjectStore(t)
+	defer destinationSrv.Close()
+	source.objects["/bucket/object"] = []byte("content")
+	source.headers["/bucket/object"] = http.Header{
+		"Content-Type":     {"text/plain"},
+		"X-Amz-Meta-Owner": {"akubra"},
+	}
+	destination.objects["/bucket/deleted"] = []byte("stale")
+
+	w := NewWorker(http.DefaultTransport, []*url.URL{sourceURL, destinationURL}, 1, 0,
+		log.New(ioutil.Discard, "", 0))
+	w.Run(mkEntries(
+		*httphandler.NewSyncLogMessageData("PUT", destinationURL.Host, "/bucket/object", sourceURL.Host, "", ""),
+		*httphandler.NewSyncLogMessageData("DELETE", destinationURL.Host, "/bucket/deleted", sourceURL.Host, "", ""),
+	))
+
+	assert.Equal(t, "content", string(destination.objects["/bucket/object"]))
+	assert.Equal(t, "text/plain", destination.headers["/bucket/object"].Get("Content-Type"))
+	assert.Equal(t, "akubra", destination.headers["/bucket/object"].Get("X-Amz-Meta-Owner"))
+	assert.NotContains(t, destination.objects, "/bucket/deleted")
+}
+
+func TestWorkerRetriesAndDeduplicates(t *testing.T) {
+	source, sourceSrv, sourceURL := mkObjectStore(t)
+	defer sourceSrv.Close()
+	destination, destinationSrv, destinationURL := mkObjectStore(t)
+	defer destinationSrv.Close()
+	source.objects["/bucket/object"] = []byte("content")
+	destination.failures = 2
+
+	w := NewWorker(http.DefaultTransport, []*url.URL{sourceURL, destinationURL}, 3, 0,
+		log.New(ioutil.Discard, "", 0))
+	entry := *httphandler.NewSyncLogMessageData("PUT", destinationURL.Host, "/bucket/object", sourceURL.Host, "", "")
+	w.Run(mkEntries(entry, entry, entry))
+
+	assert.Equal(t, "content", string(destination.objects["/bucket/object"]))
+	assert.Equal(t, int32(1), destination.puts, "Object should be replayed once")
+}
+
+func TestWorkerGivesUpAfterMaxAttempts(t *testing.T) {
+	_, sourceSrv, sourceURL := mkObjectStore(t)
+	defer sourceSrv.Close()
+	destination, destinationSrv, destinationURL := mkObjectStore(t)
+	defer destinationSrv.Close()
+	destination.failures = 10
+
+	errLog := &bytes.Buffer{}
+	w := NewWorker(http.DefaultTransport, []*url.URL{sourceURL, destinationURL}, 2, 0, log.New(errLog, "", 0))
+	w.Run(mkEntries(*httphandler.NewSyncLogMessageData("DELETE", destinationURL.Host, "/bucket/object", sourceURL.Host, "", "")))
+
+	assert.Equal(t, int32(8), destination.failures, "Delete should be attempted twice")
+	assert.Contains(t, errLog.String(), "giving up after 2 attempts")
+}
+
+func TestWorkerSkipsSubresourceWrites(t *testing.T) {
+	source, sourceSrv, sourceURL := mkObjectStore(t)
+	defer sourceSrv.Close()
+	destination, destinationSrv, destinationURL := mkObjectStore(t)
+	defer destinationSrv.Close()
+	source.objects["/bucket/object"] = []byte("content")
+	destination.objects["/bucket/object"] = []byte("content")
+	versionedDelete := *httphandler.NewSyncLogMessageData("DELETE", destinationURL.Host, "/bucket/object", sourceURL.Host, "", "")
+	versionedDelete.Query = "versionId=3HL4kqtJlcpXroDTDmjVBH40Nrjfkd"
+	abortMultipart := *httphandler.NewSyncLogMessageData("DELETE", destinationURL.Host, "/bucket/object", sourceURL.Host, "", "")
+	abortMultipart.Query = "uploadId=VXBsb2FkIElE"
+	uploadPart := *httphandler.NewSyncLogMessageData("PUT", destinationURL.Host, "/bucket/object", sourceURL.Host, "", "")
+	uploadPart.Query = "partNumber=2&uploadId=VXBsb2FkIElE"
+
+	errLog := &bytes.Buffer{}
+	w := NewWorker(http.DefaultTransport, []*url.URL{sourceURL, destinationURL}, 3, 0, log.New(errLog, "", 0))
+	w.Run(mkEntries(versionedDelete, abortMultipart, uploadPart))
+
+	assert.Equal(t, "content", string(destination.objects["/bucket/object"]))
+	assert.Empty(t, destination.hosts, "Sub-resource writes should not be replayed")
+	assert.Empty(t, source.hosts, "Object should not be copied")
+	assert.Equal(t, 3, strings.Count(errLog.String(), "Skipping"), "Skipped entries should not be retried")
+}
+
+func TestWorkerSignsReplaysAndKeepsHostHeader(t *testing.T) {
+	source, sourceSrv, sourceURL := mkObjectStore(t)
+	defer sourceSrv.Close()
+	destination, destinationSrv, destinationURL := mkObjectStore(t)
+	defer destinationSrv.Close()
+	source.objects["/object"] = []byte("content")
+	entry := *httphandler.NewSyncLogMessageData("PUT", destinationURL.Host, "/object", sourceURL.Host, "", "")
+	entry.Host = "bucket.s3.example.com"
+
+	w := NewWorker(http.DefaultTransport, []*url.URL{sourceURL, destinationURL}, 1, 0,
+		log.New(ioutil.Discard, "", 0))
+	w.Credentials = map[string]transport.Credentials{
+		sourceURL.Host:      {AccessKey: "source", SecretKey: "secret", Region: "us-east-1"},
+		destinationURL.Host: {AccessKey: "destination", SecretKey: "secret", Region: "us-east-1"},
+	}
+	w.Run(mkEntries(entry))
+
+	assert.Equal(t, "content", string(destination.objects["/object"]))
+	assert.Equal(t, []string{"bucket.s3.example.com"}, source.hosts)
+	assert.Equal(t, []string{"bucket.s3.example.com"}, destination.hosts)
+	if assert.Len(t, source.authorizations, 1) && assert.Len(t, destination.authorizations, 1) {
+		assert.Contains(t, source.authorizations[0], "Credential=source/")
+		assert.Contains(t, destination.authorizations[0], "Credential=destination/")
+	}
+}
+
+func TestReadEntries(t *testing.T) {
+	synclog := `{"method":"PUT","failedhost":"second:80","path":"/bucket/object","successhost":"first:80"}
+malformed
+{"method":"DELETE","failedhost":"first:80","path":"/bucket/other","successhost":"second:80"}
+`
+	entries := []httphandler.SyncLogMessageData{}
+	for entry := range ReadEntries(strings.NewReader(synclog), log.New(ioutil.Discard, "", 0)) {
+		entries = append(entries, entry)
+	}
+	if !assert.Len(t, entries, 2) {
+		return
+	}
+	assert.Equal(t, "second:80", entries[0].FailedHost)
+	assert.Equal(t, "DELETE", entries[1].Method)
+}
@@ -0,0 +1,185 @@
+package transport
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned if request was not sent because backend
+// circuit is open
+var ErrCircuitOpen = errors.New("Backend circuit open")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type circuit struct {
+	state     circuitState
+	failures  int
+	openedAt  time.Time
+	probes    int
+	successes int
+	// time of last probe, probes which didn't report within cooldown are
+	// considered lost
+	probedAt time.Time
+}
+
+// CircuitBreaker tracks consecutive failures per backend. After
+// failureThreshold failures circuit opens and backend receives no requests
+// for cooldown duration. Then circuit is half-open: up to halfOpenProbes
+// requests are let through, circuit closes once all of them succeeded and
+// opens again on first failure. If probes don't report within cooldown new
+// ones are let through
+type CircuitBreaker struct {
+	failureThreshold int
+	cooldown         time.Duration
+	halfOpenProbes   int
+	now              func() time.Time
+	circuits         map[string]*circuit
+	circuitsMx       sync.Mutex
+}
+
+func (cb *CircuitBreaker) circuit(backend *url.URL) *circuit {
+	c, ok := cb.circuits[backend.Host]
+	if !ok {
+		c = &circuit{}
+		cb.circuits[backend.Host] = c
+	}
+	return c
+}
+
+func (cb *CircuitBreaker) open(c *circuit) {
+	c.state = circuitOpen
+	c.openedAt = cb.now()
+}
+
+// halfOpen moves circuit which cooldown passed to half-open state and frees
+// probes lost without report
+func (cb *CircuitBreaker) halfOpen(c *circuit) {
+	now := cb.now()
+	stale := c.state == circuitHalfOpen && c.probes >= cb.halfOpenProbes &&
+		now.Sub(c.probedAt) >= cb.cooldown
+	if c.state == circuitOpen && now.Sub(c.openedAt) >= cb.cooldown || stale {
+		c.state = circuitHalfOpen
+		c.probes = 0
+		c.successes = 0
+	}
+}
+
+// available checks if request could be sent to backend, without reserving
+// half-open probe
+func (cb *CircuitBreaker) available(backend *url.URL) bool {
+	cb.circuitsMx.Lock()
+	defer cb.circuitsMx.Unlock()
+	c := cb.circuit(backend)
+	cb.halfOpen(c)
+	return c.state == circuitClosed || c.state == circuitHalfOpen && c.probes < cb.halfOpenProbes
+}
+
+// Allow checks if request may be sent to backend. It reserves half-open
+// probe, so it should be called only if request is sent
+func (cb *CircuitBreaker) Allow(backend *url.URL) bool {
+	allowed, _ := cb.acquire(backend)
+	return allowed
+}
+
+// acquire works as Allow, probe is true if half-open probe was reserved
+func (cb *CircuitBreaker) acquire(backend *url.URL) (allowed, probe bool) {
+	cb.circuitsMx.Lock()
+	defer cb.circuitsMx.Unlock()
+	c := cb.circuit(backend)
+	cb.halfOpen(c)
+	switch {
+	case c.state == circuitOpen:
+		return false, false
+	case c.state == circuitHalfOpen:
+		if c.probes >= cb.halfOpenProbes {
+			return false, false
+		}
+		c.probes++
+		c.probedAt = cb.now()
+		return true, true
+	}
+	return true, false
+}
+
+// release frees probe reserved by acquire for request which result won't be
+// reported
+func (cb *CircuitBreaker) release(backend *url.URL) {
+	cb.circuitsMx.Lock()
+	defer cb.circuitsMx.Unlock()
+	c := cb.circuit(backend)
+	if c.state == circuitHalfOpen && c.probes > 0 {
+		c.probes--
+	}
+}
+
+// Report registers result of request sent to backend
+func (cb *CircuitBreaker) Report(backend *url.URL, failed bool) {
+	cb.circuitsMx.Lock()
+	defer cb.circuitsMx.Unlock()
+	c := cb.circuit(backend)
+	switch c.state {
+	case circuitClosed:
+		if !failed {
+			c.failures = 0
+			return
+		}
+		c.failures++
+		if c.failures >= cb.failureThreshold {
+			cb.open(c)
+		}
+	case circuitHalfOpen:
+		if failed {
+			cb.open(c)
+			return
+		}
+		c.successes++
+		if c.successes >= cb.halfOpenProbes {
+			c.state = circuitClosed
+			c.failures = 0
+		}
+	}
+}
+
+// State returns circuit state ("closed", "open" or "half-open") of backends
+// which received any request, keyed by backend host
+func (cb *CircuitBreaker) State() map[string]string {
+	cb.circuitsMx.Lock()
+	defer cb.circuitsMx.Unlock()
+	state := make(map[string]string, len(cb.circuits))
+	for host, c := range cb.circuits {
+		switch {
+		case c.state == circuitClosed:
+			state[host] = "closed"
+		case c.state == circuitOpen && cb.now().Sub(c.openedAt) < cb.cooldown:
+			state[host] = "open"
+		default:
+			state[host] = "half-open"
+		}
+	}
+	return state
+}
+
+// NewCircuitBreaker creates CircuitBreaker
+func NewCircuitBreaker(failureThreshold int, cooldown time.Duration, halfOpenProbes int) *CircuitBreaker {
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	if halfOpenProbes < 1 {
+		halfOpenProbes = 1
+	}
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		halfOpenProbes:   halfOpenProbes,
+		now:              time.Now,
+		circuits:         make(map[string]*circuit),
+	}
+}
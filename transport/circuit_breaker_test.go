@@ -0,0 +1,156 @@
+package transport
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	current time.Time
+}
+
+func (fc *fakeClock) now() time.Time {
+	return fc.current
+}
+
+func TestCircuitBreakerStateTransitions(t *testing.T) {
+	clock := &fakeClock{time.Now()}
+	cb := NewCircuitBreaker(2, time.Minute, 2)
+	cb.now = clock.now
+	backend := &url.URL{Scheme: "http", Host: "s3.internal"}
+	other := &url.URL{Scheme: "http", Host: "s3.other.internal"}
+
+	cb.Report(backend, true)
+	if !cb.Allow(backend) {
+		t.Error("Circuit should be closed below failure threshold")
+	}
+	cb.Report(backend, true)
+	if cb.Allow(backend) {
+		t.Error("Circuit should open after reaching failure threshold")
+	}
+	if !cb.Allow(other) {
+		t.Error("Other backends circuits should stay closed")
+	}
+
+	clock.current = clock.current.Add(time.Minute)
+	if !cb.Allow(backend) || !cb.Allow(backend) {
+		t.Error("Half-open circuit should let probes through")
+	}
+	if cb.Allow(backend) {
+		t.Error("Half-open circuit should limit number of probes")
+	}
+	cb.Report(backend, false)
+	cb.Report(backend, true)
+	if cb.Allow(backend) {
+		t.Error("Failed probe should open circuit again")
+	}
+
+	clock.current = clock.current.Add(time.Minute)
+	cb.Allow(backend)
+	cb.Allow(backend)
+	cb.Report(backend, false)
+	cb.Report(backend, false)
+	if !cb.Allow(backend) || !cb.Allow(backend) || !cb.Allow(backend) {
+		t.Error("Circuit should close after successful probes")
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	cb := NewCircuitBreaker(2, time.Minute, 1)
+	backend := &url.URL{Scheme: "http", Host: "s3.internal"}
+	cb.Report(backend, true)
+	cb.Report(backend, false)
+	cb.Report(backend, true)
+	if !cb.Allow(backend) {
+		t.Error("Only consecutive failures should open circuit")
+	}
+}
+
+func TestOpenCircuitBackendIsSkipped(t *testing.T) {
+	urls := []*url.URL{{Scheme: "http", Host: "first.internal"}, {Scheme: "http", Host: "second.internal"}}
+	transp := NewMultiTransport(nil, urls, nil)
+	transp.CircuitBreaker = NewCircuitBreaker(1, time.Minute, 1)
+	transp.CircuitBreaker.Report(urls[0], true)
+	active := transp.activeBackends()
+	if len(active) != 1 || active[0] != urls[1] {
+		t.Errorf("Backend with open circuit should be skipped, got %v", active)
+	}
+}
+
+func TestCircuitBreakerState(t *testing.T) {
+	clock := &fakeClock{time.Now()}
+	cb := NewCircuitBreaker(1, time.Minute, 1)
+	cb.now = clock.now
+	backend := &url.URL{Scheme: "http", Host: "s3.internal"}
+	other := &url.URL{Scheme: "http", Host: "s3.other.internal"}
+
+	cb.Report(other, false)
+	cb.Report(backend, true)
+	state := cb.State()
+	if state["s3.internal"] != "open" || state["s3.other.internal"] != "closed" {
+		t.Errorf("Unexpected circuits state %v", state)
+	}
+	clock.current = clock.current.Add(time.Minute)
+	if cb.State()["s3.internal"] != "half-open" {
+		t.Error("Circuit should be half-open after cooldown")
+	}
+}
+
+func TestCircuitBreakerProbesAreNotLost(t *testing.T) {
+	clock := &fakeClock{time.Now()}
+	cb := NewCircuitBreaker(1, time.Minute, 1)
+	cb.now = clock.now
+	backend := &url.URL{Scheme: "http", Host: "s3.internal"}
+	cb.Report(backend, true)
+	clock.current = clock.current.Add(time.Minute)
+
+	if !cb.available(backend) || !cb.available(backend) {
+		t.Error("Checking availability should not reserve probes")
+	}
+	allowed, probe := cb.acquire(backend)
+	if !allowed || !probe {
+		t.Fatal("Half-open circuit should let probe through")
+	}
+	if cb.Allow(backend) {
+		t.Error("Probe should be reserved until it's reported or released")
+	}
+	cb.release(backend)
+	if !cb.Allow(backend) {
+		t.Error("Released probe should be available again")
+	}
+
+	clock.current = clock.current.Add(time.Hour)
+	if !cb.Allow(backend) {
+		t.Error("Probe which did not report within cooldown should be replaced")
+	}
+}
+
+func TestUnsentRequestsDoNotTakeProbes(t *testing.T) {
+	ts, u := mkOKSrv()
+	defer ts.Close()
+	other := &url.URL{Scheme: "http", Host: "localhost:" + u.Port()}
+	transp := NewMultiTransport(nil, []*url.URL{u, other}, nil)
+	transp.ReplicatedMethods = map[string]bool{}
+	clock := &fakeClock{time.Now()}
+	transp.CircuitBreaker = NewCircuitBreaker(1, time.Minute, 1)
+	transp.CircuitBreaker.now = clock.now
+	transp.CircuitBreaker.Report(u, true)
+	transp.CircuitBreaker.Report(other, true)
+	clock.current = clock.current.Add(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/bucket/object", nil)
+		resp, err := transp.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Request %d should succeed, got %s", i, err)
+		}
+		_ = resp.Body.Close()
+	}
+	for _, backend := range []*url.URL{u, other} {
+		if !transp.CircuitBreaker.Allow(backend) {
+			t.Errorf("Backend %s should not lose probes to requests it didn't receive", backend.Host)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// BadDigestError is returned if MD5 of request body differs from one given
+// in Content-MD5 header
+type BadDigestError struct {
+	Expected string
+	Computed string
+}
+
+func (e *BadDigestError) Error() string {
+	return fmt.Sprintf("Content-MD5 %q does not match body MD5 %q", e.Expected, e.Computed)
+}
+
+// digestReader computes MD5 of body while it's read. Read of last bytes
+// fails if digest differs from expected, so they never reach backends
+type digestReader struct {
+	r         io.Reader
+	remaining int64
+	hash      hash.Hash
+	expected  string
+}
+
+func newDigestReader(r io.Reader, length int64, expected string) *digestReader {
+	return &digestReader{r: r, remaining: length, hash: md5.New(), expected: expected}
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	_, _ = dr.hash.Write(p[:n])
+	dr.remaining -= int64(n)
+	if n > 0 && dr.remaining <= 0 {
+		computed := base64.StdEncoding.EncodeToString(dr.hash.Sum(nil))
+		if computed != dr.expected {
+			return 0, &BadDigestError{dr.expected, computed}
+		}
+	}
+	return n, err
+}
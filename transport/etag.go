@@ -0,0 +1,67 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ETagMismatchError is returned if backend response ETag differs from MD5
+// of request body sent to it
+type ETagMismatchError struct {
+	Expected, Got string
+}
+
+func (e *ETagMismatchError) Error() string {
+	return fmt.Sprintf("backend returned ETag %q, body MD5 is %q", e.Got, e.Expected)
+}
+
+// bodyDigest is MD5 of request body computed while it is copied to
+// backends, sum is empty if body was not copied completely
+type bodyDigest struct {
+	done chan struct{}
+	sum  string
+}
+
+type bodyDigestKey struct{}
+
+// isEncrypted checks if response describes object encrypted with SSE-KMS or
+// SSE-C, which ETag is not MD5 of body
+func isEncrypted(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("X-Amz-Server-Side-Encryption"), "aws:kms") ||
+		resp.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != ""
+}
+
+// VerifyETag checks if ETag of response matches MD5 of request body, if
+// MultiTransport.VerifyETags is set. Multipart upload and encrypted objects
+// ETags are not MD5 of body, so they are not checked
+func VerifyETag(req *http.Request, resp *http.Response) error {
+	digest, ok := req.Context().Value(bodyDigestKey{}).(*bodyDigest)
+	if !ok {
+		return nil
+	}
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if etag == "" || strings.Contains(etag, "-") || isEncrypted(resp) {
+		return nil
+	}
+	// backend may respond before body is copied to remaining backends
+	select {
+	case <-digest.done:
+	case <-req.Context().Done():
+		return nil
+	}
+	if digest.sum == "" || strings.EqualFold(digest.sum, etag) {
+		return nil
+	}
+	return &ETagMismatchError{digest.sum, etag}
+}
+
+// withBodyDigest returns context of backend requests which responses ETags
+// are verified against digest
+func withBodyDigest(ctx context.Context, digest *bodyDigest) context.Context {
+	if digest == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, bodyDigestKey{}, digest)
+}
@@ -0,0 +1,145 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HealthChecker periodically probes backends and ejects ones which failed
+// FailureThreshold consecutive probes. Ejected backend is restored after
+// first successful probe
+type HealthChecker struct {
+	roundTripper     http.RoundTripper
+	backends         []*url.URL
+	path             string
+	interval         time.Duration
+	failureThreshold int
+	failures         map[string]int
+	failuresMx       sync.RWMutex
+	stop             chan struct{}
+	stopOnce         sync.Once
+}
+
+// probe returns true if backend responded with status lower than 500 within
+// interval, so probes of hanging backend don't pile up
+func (hc *HealthChecker) probe(backend *url.URL) bool {
+	probeURL := *backend
+	probeURL.Path = hc.path
+	req, err := http.NewRequest("GET", probeURL.String(), nil)
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hc.interval)
+	defer cancel()
+	resp, err := hc.roundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	closeErr := resp.Body.Close()
+	return err == nil && closeErr == nil && resp.StatusCode < 500
+}
+
+// CheckNow probes all backends once
+func (hc *HealthChecker) CheckNow() {
+	results := make(map[string]bool, len(hc.backends))
+	resultsMx := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, backend := range hc.backends {
+		wg.Add(1)
+		go func(backend *url.URL) {
+			defer wg.Done()
+			healthy := hc.probe(backend)
+			resultsMx.Lock()
+			results[backend.Host] = healthy
+			resultsMx.Unlock()
+		}(backend)
+	}
+	wg.Wait()
+
+	hc.failuresMx.Lock()
+	defer hc.failuresMx.Unlock()
+	for host, healthy := range results {
+		if healthy {
+			hc.failures[host] = 0
+		} else {
+			hc.failures[host]++
+		}
+	}
+}
+
+// Start probes backends every interval until Stop is called
+func (hc *HealthChecker) Start() {
+	go func() {
+		ticker := time.NewTicker(hc.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hc.stop:
+				return
+			case <-ticker.C:
+				hc.CheckNow()
+			}
+		}
+	}()
+}
+
+// Stop stops periodic probing, it may be called more than once
+func (hc *HealthChecker) Stop() {
+	hc.stopOnce.Do(func() {
+		close(hc.stop)
+	})
+}
+
+// Healthy checks if backend is not ejected
+func (hc *HealthChecker) Healthy(backend *url.URL) bool {
+	hc.failuresMx.RLock()
+	defer hc.failuresMx.RUnlock()
+	return hc.failures[backend.Host] < hc.failureThreshold
+}
+
+// HealthyCount returns number of backends which are not ejected
+func (hc *HealthChecker) HealthyCount() int {
+	count := 0
+	for _, backend := range hc.backends {
+		if hc.Healthy(backend) {
+			count++
+		}
+	}
+	return count
+}
+
+// State returns health of all backends keyed by backend host
+func (hc *HealthChecker) State() map[string]bool {
+	state := make(map[string]bool, len(hc.backends))
+	for _, backend := range hc.backends {
+		state[backend.Host] = hc.Healthy(backend)
+	}
+	return state
+}
+
+// NewHealthChecker creates HealthChecker probing path on backends every
+// interval. If roundTripper is nil http.DefaultTransport is used
+func NewHealthChecker(roundTripper http.RoundTripper, backends []*url.URL,
+	path string, interval time.Duration, failureThreshold int) *HealthChecker {
+	if roundTripper == nil {
+		roundTripper = http.DefaultTransport
+	}
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	return &HealthChecker{
+		roundTripper:     roundTripper,
+		backends:         backends,
+		path:             path,
+		interval:         interval,
+		failureThreshold: failureThreshold,
+		failures:         make(map[string]int),
+		stop:             make(chan struct{}),
+	}
+}
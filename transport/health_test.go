@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func mkCountingSrv(t *testing.T, statusCode *int32, calls *int32) (*httptest.Server, *url.URL) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			atomic.AddInt32(calls, 1)
+		}
+		_, err := io.Copy(ioutil.Discard, r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(statusCode)))
+	}))
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts, u
+}
+
+func TestUnhealthyBackendIsEjected(t *testing.T) {
+	statuses := []int32{http.StatusOK, http.StatusOK, http.StatusServiceUnavailable}
+	calls := make([]int32, len(statuses))
+	urls := make([]*url.URL, 0, len(statuses))
+	for i := range statuses {
+		ts, u := mkCountingSrv(t, &statuses[i], &calls[i])
+		defer ts.Close()
+		urls = append(urls, u)
+	}
+	hc := NewHealthChecker(nil, urls, "/health", time.Hour, 2)
+	transp := NewMultiTransport(nil, urls, nil)
+	transp.HealthChecker = hc
+
+	hc.CheckNow()
+	if !hc.Healthy(urls[2]) {
+		t.Error("Backend should not be ejected before reaching failure threshold")
+	}
+	hc.CheckNow()
+	state := hc.State()
+	if state[urls[2].Host] || !state[urls[0].Host] || !state[urls[1].Host] {
+		t.Errorf("Only failing backend should be ejected, got %v", state)
+	}
+
+	_, err := transp.RoundTrip(dummyReq([]byte("zażółć gęślą jaźń"), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait for remaining backends
+	<-time.After(50 * time.Millisecond)
+	if atomic.LoadInt32(&calls[2]) != 0 {
+		t.Error("Ejected backend should not receive requests")
+	}
+	if atomic.LoadInt32(&calls[0]) != 1 || atomic.LoadInt32(&calls[1]) != 1 {
+		t.Error("Healthy backends should receive requests")
+	}
+
+	atomic.StoreInt32(&statuses[2], http.StatusOK)
+	hc.CheckNow()
+	if !hc.Healthy(urls[2]) {
+		t.Error("Backend should be restored after successful probe")
+	}
+}
+
+func TestAllBackendsEjected(t *testing.T) {
+	urls := []*url.URL{{Scheme: "http", Host: "first.internal"}, {Scheme: "http", Host: "second.internal"}}
+	transp := NewMultiTransport(nil, urls, nil)
+	transp.HealthChecker = NewHealthChecker(nil, urls, "/health", time.Hour, 1)
+	transp.HealthChecker.failures["first.internal"] = 1
+	transp.HealthChecker.failures["second.internal"] = 1
+	if len(transp.activeBackends()) != len(urls) {
+		t.Error("Requests should be sent to all backends if all are ejected")
+	}
+}
+
+func TestHangingBackendProbeTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+	u, _ := url.Parse(ts.URL)
+	hc := NewHealthChecker(nil, []*url.URL{u}, "/health", 20*time.Millisecond, 1)
+
+	done := make(chan struct{})
+	go func() {
+		hc.CheckNow()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Probe should time out after interval")
+	}
+	if hc.Healthy(u) {
+		t.Error("Backend which didn't respond in time should be ejected")
+	}
+
+	hc.Start()
+	hc.Stop()
+	hc.Stop()
+}
@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrBackendBusy is returned if backend has no free request slot
+var ErrBackendBusy = errors.New("Backend busy")
+
+// BackendLimiter limits number of in flight requests per backend, so single
+// slow backend can't take all connections. Slot is taken until response
+// body is read to the end or closed
+type BackendLimiter struct {
+	limit int
+	// requests wait for free slot up to queueTimeout, 0 means fail fast
+	queueTimeout time.Duration
+	slots        map[string]chan struct{}
+	slotsMx      sync.Mutex
+}
+
+func (bl *BackendLimiter) backendSlots(host string) chan struct{} {
+	bl.slotsMx.Lock()
+	defer bl.slotsMx.Unlock()
+	slots, ok := bl.slots[host]
+	if !ok {
+		slots = make(chan struct{}, bl.limit)
+		bl.slots[host] = slots
+	}
+	return slots
+}
+
+// acquire takes request slot of backend request is addressed to
+func (bl *BackendLimiter) acquire(req *http.Request) (release func(), err error) {
+	slots := bl.backendSlots(req.URL.Host)
+	release = func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if bl.queueTimeout == 0 {
+		return nil, ErrBackendBusy
+	}
+	timer := time.NewTimer(bl.queueTimeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ErrBackendBusy
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+// NewBackendLimiter creates BackendLimiter allowing limit in flight requests
+// per backend. Requests wait for free slot up to queueTimeout, if it is 0
+// they fail immediately with ErrBackendBusy
+func NewBackendLimiter(limit int, queueTimeout time.Duration) *BackendLimiter {
+	return &BackendLimiter{
+		limit:        limit,
+		queueTimeout: queueTimeout,
+		slots:        make(map[string]chan struct{}),
+	}
+}
+
+// releasingBody releases request slot once body is read to the end or closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (rb *releasingBody) Read(p []byte) (int, error) {
+	n, err := rb.ReadCloser.Read(p)
+	if err != nil {
+		rb.once.Do(rb.release)
+	}
+	return n, err
+}
+
+func (rb *releasingBody) Close() error {
+	rb.once.Do(rb.release)
+	return rb.ReadCloser.Close()
+}
+
+// limitedRoundTrip sends request once backend has free request slot
+func (mt *MultiTransport) limitedRoundTrip(req *http.Request) (*http.Response, error) {
+	if mt.BackendLimiter == nil {
+		return mt.roundTrip(req)
+	}
+	release, err := mt.BackendLimiter.acquire(req)
+	if err != nil {
+		// request body is closed as RoundTripper would do, so body copying
+		// doesn't wait for this backend
+		if req.Body != nil {
+			if closeErr := req.Body.Close(); closeErr != nil {
+				return nil, closeErr
+			}
+		}
+		return nil, err
+	}
+	resp, err := mt.roundTrip(req)
+	if err != nil || resp.Body == nil {
+		release()
+		return resp, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, err
+}
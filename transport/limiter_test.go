@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBackendLimiterQueuesRequests(t *testing.T) {
+	limiter := NewBackendLimiter(1, 50*time.Millisecond)
+	req, _ := http.NewRequest("GET", "http://backend:8080/bucket/object", nil)
+	other, _ := http.NewRequest("GET", "http://other:8080/bucket/object", nil)
+
+	release, err := limiter.acquire(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = limiter.acquire(other); err != nil {
+		t.Error("Other backend slots should not be affected")
+	}
+	start := time.Now()
+	if _, err = limiter.acquire(req); err != ErrBackendBusy {
+		t.Errorf("Expected ErrBackendBusy, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Request should wait for free slot up to queue timeout")
+	}
+	go func() {
+		<-time.After(10 * time.Millisecond)
+		release()
+	}()
+	if _, err = limiter.acquire(req); err != nil {
+		t.Errorf("Request should get released slot, got %v", err)
+	}
+}
+
+func TestSaturatedBackendDoesNotAffectOthers(t *testing.T) {
+	unblock := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer slow.Close()
+	defer close(unblock)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer fast.Close()
+	slowURL, _ := url.Parse(slow.URL)
+	fastURL, _ := url.Parse(fast.URL)
+	tuples := make(chan *ReqResErrTuple, 4)
+	transp := NewMultiTransport(nil, []*url.URL{slowURL, fastURL}, func(in <-chan *ReqResErrTuple) *ReqResErrTuple {
+		out := make(chan *ReqResErrTuple, 1)
+		go func() {
+			passed := false
+			for tup := range in {
+				tuples <- tup
+				if !tup.Failed && !passed {
+					out <- tup
+					passed = true
+				}
+			}
+		}()
+		return <-out
+	})
+	transp.BackendLimiter = NewBackendLimiter(1, 0)
+
+	for i := 0; i < 2; i++ {
+		resp, err := transp.RoundTrip(dummyReq([]byte("content"), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Request.URL.Host != fastURL.Host {
+			t.Errorf("Expected response of %s, got %s", fastURL.Host, resp.Request.URL.Host)
+		}
+		if err = resp.Body.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+	select {
+	case tup := <-tuples:
+		for tup.Req.URL.Host != slowURL.Host {
+			tup = <-tuples
+		}
+		if tup.Err != ErrBackendBusy {
+			t.Errorf("Request to saturated backend should fail with ErrBackendBusy, got %v", tup.Err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Request to saturated backend should fail immediately")
+	}
+}
@@ -0,0 +1,54 @@
+package transport
+
+import "fmt"
+
+// QuorumError is returned if fewer backends than write quorum handled write
+// successfully
+type QuorumError struct {
+	Required, Succeeded int
+	// Cause is error backend request failed with, if any
+	Cause error
+}
+
+func (e *QuorumError) Error() string {
+	msg := fmt.Sprintf("write quorum not met: %d of required %d backends succeeded", e.Succeeded, e.Required)
+	if e.Cause != nil {
+		msg += ", backend error: " + e.Cause.Error()
+	}
+	return msg
+}
+
+// awaitQuorum holds responses until quorum of successful responses came in,
+// then passes them and all following ones. If quorum can't be met, all
+// responses are passed with QuorumError, so none of them is treated as
+// successful
+func awaitQuorum(quorum int, in <-chan *ReqResErrTuple) <-chan *ReqResErrTuple {
+	out := make(chan *ReqResErrTuple)
+	go func() {
+		defer close(out)
+		held := []*ReqResErrTuple{}
+		succeeded := 0
+		for r := range in {
+			held = append(held, r)
+			if !r.Failed {
+				succeeded++
+			}
+			if succeeded >= quorum {
+				break
+			}
+		}
+		if succeeded < quorum {
+			for _, r := range held {
+				r.Err = &QuorumError{quorum, succeeded, r.Err}
+				r.Failed = true
+			}
+		}
+		for _, r := range held {
+			out <- r
+		}
+		for r := range in {
+			out <- r
+		}
+	}()
+	return out
+}
@@ -0,0 +1,69 @@
+package transport
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func mkQuorumTransport(statuses map[string]int, quorum int) *MultiTransport {
+	backends := []*url.URL{}
+	for host := range statuses {
+		backends = append(backends, &url.URL{Scheme: "http", Host: host})
+	}
+	transp := NewMultiTransport(&hostRoundTripper{statuses: statuses}, backends, nil)
+	transp.WriteQuorum = quorum
+	return transp
+}
+
+func TestWriteQuorumMet(t *testing.T) {
+	transp := mkQuorumTransport(map[string]int{
+		"first:8080":  http.StatusOK,
+		"second:8080": http.StatusOK,
+		"third:8080":  http.StatusInternalServerError,
+	}, 2)
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("content"))
+
+	resp, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Write succeeded on quorum of backends, got %d", resp.StatusCode)
+	}
+}
+
+func TestWriteQuorumFailed(t *testing.T) {
+	transp := mkQuorumTransport(map[string]int{
+		"first:8080":  http.StatusOK,
+		"second:8080": http.StatusInternalServerError,
+		"third:8080":  http.StatusServiceUnavailable,
+	}, 2)
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("content"))
+
+	_, err := transp.RoundTrip(req)
+	quorumErr, ok := err.(*QuorumError)
+	if !ok {
+		t.Fatalf("Expected QuorumError, got %v", err)
+	}
+	if quorumErr.Required != 2 || quorumErr.Succeeded != 1 {
+		t.Errorf("Unexpected quorum error %q", quorumErr)
+	}
+}
+
+func TestWriteQuorumDoesNotApplyToReads(t *testing.T) {
+	transp := mkQuorumTransport(map[string]int{
+		"first:8080":  http.StatusOK,
+		"second:8080": http.StatusInternalServerError,
+	}, 2)
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/object", nil)
+
+	resp, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Read should succeed on any backend, got %d", resp.StatusCode)
+	}
+}
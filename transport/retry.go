@@ -0,0 +1,180 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retryable backend error classes
+const (
+	// RetryDialErrors covers failures to establish connection
+	RetryDialErrors = "dial"
+	// RetryTimeouts covers network timeouts
+	RetryTimeouts = "timeout"
+	// RetryConnectionResets covers connections reset or closed by backend
+	// before response was received
+	RetryConnectionResets = "reset"
+)
+
+// errorClass returns retryable class of error or empty string
+func errorClass(err error) string {
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+		return RetryDialErrors
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return RetryTimeouts
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF ||
+		strings.Contains(err.Error(), "connection reset by peer") {
+		return RetryConnectionResets
+	}
+	return ""
+}
+
+// RetryPolicy defines how requests failed due to transient backend errors
+// are retried. Request body is streamed from client once, so requests with
+// body are retried only if it's buffered. Backend may have processed non
+// idempotent requests (e.g. POST) which failed after connection was
+// established, so they are retried only after dial errors
+type RetryPolicy struct {
+	// MaxRetries is maximal number of retries per backend request
+	MaxRetries int
+	// Backoff is delay before first retry, doubled on each next one
+	Backoff time.Duration
+	// RetryableClasses lists error classes which are retried
+	RetryableClasses []string
+	// Bodies of requests up to MaxBodyBytes long are buffered in memory, so
+	// they can be retried. Requests with body are not retried if 0
+	MaxBodyBytes int64
+	// BudgetRatio limits retries to given fraction of backend requests, so
+	// retries don't multiply load of failing backend. Defaults to
+	// defaultRetryBudgetRatio
+	BudgetRatio float64
+	// budget is token bucket, each request deposits BudgetRatio tokens and
+	// each retry takes one. spent counts tokens missing in full bucket
+	budgetMx sync.Mutex
+	spent    float64
+}
+
+const (
+	// defaultRetryBudgetRatio allows one retry per ten requests
+	defaultRetryBudgetRatio = 0.1
+	// retryBudgetBurst is number of retries available in full bucket
+	retryBudgetBurst = 10
+)
+
+// deposit adds tokens for request to budget
+func (rp *RetryPolicy) deposit() {
+	ratio := rp.BudgetRatio
+	if ratio <= 0 {
+		ratio = defaultRetryBudgetRatio
+	}
+	rp.budgetMx.Lock()
+	defer rp.budgetMx.Unlock()
+	rp.spent -= ratio
+	if rp.spent < 0 {
+		rp.spent = 0
+	}
+}
+
+// withdraw takes token for retry from budget, false is returned if budget
+// is exhausted
+func (rp *RetryPolicy) withdraw() bool {
+	rp.budgetMx.Lock()
+	defer rp.budgetMx.Unlock()
+	if rp.spent+1 > retryBudgetBurst {
+		return false
+	}
+	rp.spent++
+	return true
+}
+
+// isIdempotent checks if repeating request with method has same effect as
+// sending it once
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryableClasses returns error classes requests with method are retried on
+func (rp *RetryPolicy) retryableClasses(method string) []string {
+	if isIdempotent(method) {
+		return rp.RetryableClasses
+	}
+	for _, class := range rp.RetryableClasses {
+		if class == RetryDialErrors {
+			return []string{RetryDialErrors}
+		}
+	}
+	return nil
+}
+
+// bufferBody reads body of request which may be retried into memory. Nil is
+// returned if request has no body, it's too long to be buffered or request
+// is never retried
+func (rp *RetryPolicy) bufferBody(req *http.Request) ([]byte, error) {
+	if rp == nil || req.Body == nil || req.ContentLength <= 0 || req.ContentLength > rp.MaxBodyBytes ||
+		len(rp.retryableClasses(req.Method)) == 0 {
+		return nil, nil
+	}
+	defer func() { _ = req.Body.Close() }()
+	body := make([]byte, req.ContentLength)
+	if _, err := io.ReadFull(req.Body, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (rp *RetryPolicy) shouldRetry(req *http.Request, replayable bool, err error, attempt int) bool {
+	if attempt >= rp.MaxRetries || !replayable {
+		return false
+	}
+	class := errorClass(err)
+	for _, retryable := range rp.retryableClasses(req.Method) {
+		if class != "" && class == retryable {
+			return rp.withdraw()
+		}
+	}
+	return false
+}
+
+func (rp *RetryPolicy) backoff(attempt int) time.Duration {
+	return rp.Backoff * time.Duration(1<<uint(attempt))
+}
+
+// roundTrip sends request retrying it according to RetryPolicy
+func (mt *MultiTransport) roundTrip(req *http.Request) (resp *http.Response, err error) {
+	body, err := mt.RetryPolicy.bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	replayable := req.ContentLength == 0 || body != nil
+	if mt.RetryPolicy != nil {
+		mt.RetryPolicy.deposit()
+	}
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if body != nil {
+			attemptReq = req.WithContext(req.Context())
+			attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		resp, err = mt.RoundTripper.RoundTrip(attemptReq)
+		if err == nil || mt.RetryPolicy == nil || !mt.RetryPolicy.shouldRetry(req, replayable, err, attempt) {
+			return
+		}
+		select {
+		case <-req.Context().Done():
+			return
+		case <-time.After(mt.RetryPolicy.backoff(attempt)):
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type flakyRoundTripper struct {
+	failures int
+	attempts int
+}
+
+func (frt *flakyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	frt.attempts++
+	if frt.attempts <= frt.failures {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func mkOKSrv() (*httptest.Server, *url.URL) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	u, _ := url.Parse(ts.URL)
+	return ts, u
+}
+
+func TestRetryTransientError(t *testing.T) {
+	ts, u := mkOKSrv()
+	defer ts.Close()
+	flaky := &flakyRoundTripper{failures: 1}
+	transp := NewMultiTransport(flaky, []*url.URL{u}, nil)
+	transp.RetryPolicy = &RetryPolicy{
+		MaxRetries:       2,
+		Backoff:          time.Millisecond,
+		RetryableClasses: []string{RetryDialErrors}}
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/object", nil)
+	resp, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Request should succeed after retry, got %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || flaky.attempts != 2 {
+		t.Errorf("Expected success on second attempt, got %d after %d attempts", resp.StatusCode, flaky.attempts)
+	}
+}
+
+func TestRetryLimits(t *testing.T) {
+	ts, u := mkOKSrv()
+	defer ts.Close()
+	flaky := &flakyRoundTripper{failures: 5}
+	transp := NewMultiTransport(flaky, []*url.URL{u}, nil)
+	transp.RetryPolicy = &RetryPolicy{
+		MaxRetries:       2,
+		Backoff:          time.Millisecond,
+		RetryableClasses: []string{RetryDialErrors}}
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/object", nil)
+	_, err := transp.RoundTrip(req)
+	if err == nil || flaky.attempts != 3 {
+		t.Errorf("Expected error after 3 attempts, got %v after %d", err, flaky.attempts)
+	}
+
+	flaky.attempts = 0
+	transp.RetryPolicy.RetryableClasses = []string{RetryTimeouts}
+	req, _ = http.NewRequest("GET", "http://example.com/bucket/object", nil)
+	_, err = transp.RoundTrip(req)
+	if err == nil || flaky.attempts != 1 {
+		t.Errorf("Not retryable errors should not be retried, got %d attempts", flaky.attempts)
+	}
+
+	flaky.attempts = 0
+	transp.RetryPolicy.RetryableClasses = []string{RetryDialErrors}
+	_, err = transp.RoundTrip(dummyReq([]byte("body"), 0))
+	if err == nil || flaky.attempts != 1 {
+		t.Errorf("Requests with body should not be retried, got %d attempts", flaky.attempts)
+	}
+}
+
+// resettingRoundTripper consumes part of body of first request to given host
+// and fails it as if connection was reset
+type resettingRoundTripper struct {
+	host  string
+	reset bool
+}
+
+func (rrt *resettingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == rrt.host && !rrt.reset {
+		rrt.reset = true
+		_, _ = req.Body.Read(make([]byte, 2))
+		return nil, io.ErrUnexpectedEOF
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRetryBufferedBody(t *testing.T) {
+	bodies := make(chan string, 3)
+	mkSrv := func() (*httptest.Server, *url.URL) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies <- string(body)
+		}))
+		u, _ := url.Parse(ts.URL)
+		return ts, u
+	}
+	ts1, u1 := mkSrv()
+	defer ts1.Close()
+	ts2, u2 := mkSrv()
+	defer ts2.Close()
+	transp := NewMultiTransport(&resettingRoundTripper{host: u2.Host}, []*url.URL{u1, u2}, nil)
+	transp.RetryPolicy = &RetryPolicy{
+		MaxRetries:       1,
+		Backoff:          time.Millisecond,
+		RetryableClasses: []string{RetryConnectionResets},
+		MaxBodyBytes:     1024}
+
+	req := dummyReq([]byte("object body"), 0)
+	req.Method = "PUT"
+	resp, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Request should succeed, got %s", err)
+	}
+	_ = resp.Body.Close()
+	transp.WaitForWrites(time.Second)
+	close(bodies)
+	received := 0
+	for body := range bodies {
+		received++
+		if body != "object body" {
+			t.Errorf("Backend should receive full body, got %q", body)
+		}
+	}
+	if received != 2 {
+		t.Errorf("Expected body received by 2 backends, got %d", received)
+	}
+}
+
+// resetRoundTripper fails all requests as if connection was reset
+type resetRoundTripper struct {
+	attempts int
+}
+
+func (rrt *resetRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rrt.attempts++
+	return nil, io.ErrUnexpectedEOF
+}
+
+func TestNonIdempotentRequestsRetriedOnlyAfterDialErrors(t *testing.T) {
+	ts, u := mkOKSrv()
+	defer ts.Close()
+	reset := &resetRoundTripper{}
+	transp := NewMultiTransport(reset, []*url.URL{u}, nil)
+	transp.RetryPolicy = &RetryPolicy{
+		MaxRetries:       2,
+		Backoff:          time.Millisecond,
+		RetryableClasses: []string{RetryDialErrors, RetryConnectionResets},
+		MaxBodyBytes:     1024}
+
+	req, _ := http.NewRequest("POST", "http://example.com/bucket/object?uploads", nil)
+	_, err := transp.RoundTrip(req)
+	if err == nil || reset.attempts != 1 {
+		t.Errorf("POST could be processed by backend, it should not be retried, got %d attempts", reset.attempts)
+	}
+
+	reset.attempts = 0
+	req, _ = http.NewRequest("DELETE", "http://example.com/bucket/object", nil)
+	_, err = transp.RoundTrip(req)
+	if err == nil || reset.attempts != 3 {
+		t.Errorf("Idempotent requests should be retried, got %d attempts", reset.attempts)
+	}
+
+	flaky := &flakyRoundTripper{failures: 1}
+	transp.RoundTripper = flaky
+	req = dummyReq([]byte("<CompleteMultipartUpload/>"), 0)
+	req.Method = "POST"
+	resp, err := transp.RoundTrip(req)
+	if err != nil || flaky.attempts != 2 {
+		t.Fatalf("POST not sent due to dial error should be retried, got %v after %d attempts", err, flaky.attempts)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestRetryBudget(t *testing.T) {
+	ts, u := mkOKSrv()
+	defer ts.Close()
+	flaky := &flakyRoundTripper{failures: 1000}
+	transp := NewMultiTransport(flaky, []*url.URL{u}, nil)
+	transp.RetryPolicy = &RetryPolicy{
+		MaxRetries:       3,
+		RetryableClasses: []string{RetryDialErrors},
+		BudgetRatio:      0.5}
+
+	attempts := []int{}
+	for i := 0; i < 10; i++ {
+		flaky.attempts = 0
+		req, _ := http.NewRequest("GET", "http://example.com/bucket/object", nil)
+		if _, err := transp.RoundTrip(req); err == nil {
+			t.Fatal("Request should fail")
+		}
+		attempts = append(attempts, flaky.attempts)
+	}
+	// burst of 10 retries is spent first, then every two requests earn one retry
+	expected := []int{4, 4, 4, 3, 2, 1, 2, 1, 2, 1}
+	if fmt.Sprint(attempts) != fmt.Sprint(expected) {
+		t.Errorf("Expected attempts %v limited by retry budget, got %v", expected, attempts)
+	}
+}
@@ -0,0 +1,184 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Credentials are used to sign backend requests with AWS Signature Version 4
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+	Region    string
+	// Service defaults to "s3"
+	Service string
+}
+
+// ErrCannotResign is returned for requests which signature can't be replaced
+var ErrCannotResign = errors.New("request can't be signed again")
+
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat  = "20060102T150405Z"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-"
+)
+
+// emptyPayloadHash is SHA256 of empty payload
+var emptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode encodes s as AWS requires, every byte except unreserved
+// characters is percent encoded. Slashes are kept if encodeSlash is false
+func awsURIEncode(s string, encodeSlash bool) string {
+	encoded := bytes.Buffer{}
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+// canonicalQuery returns query with encoded parameters sorted by name and value
+func canonicalQuery(query url.Values) string {
+	params := []string{}
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// signedHeaders returns lowercased names of signed headers, sorted, and
+// canonical headers block
+func signedHeaders(req *http.Request) (names []string, canonical string) {
+	values := map[string]string{"host": req.Host}
+	for name, headerValues := range req.Header {
+		lower := strings.ToLower(name)
+		if !strings.HasPrefix(lower, "x-amz-") && lower != "content-type" && lower != "content-md5" {
+			continue
+		}
+		trimmed := make([]string, len(headerValues))
+		for i, value := range headerValues {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		values[lower] = strings.Join(trimmed, ",")
+	}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = name + ":" + values[name] + "\n"
+	}
+	return names, strings.Join(lines, "")
+}
+
+// signV4 replaces request signature with AWS Signature Version 4 computed
+// with credentials. Body is not read, payload is signed only if client
+// provided its hash in X-Amz-Content-Sha256 header. Anonymous requests are
+// not signed, so they don't gain backend credentials privileges
+func signV4(req *http.Request, credentials Credentials, now time.Time) error {
+	query := req.URL.Query()
+	if req.Header.Get("Authorization") == "" && query.Get("X-Amz-Signature") == "" && query.Get("Signature") == "" {
+		return nil
+	}
+	if req.Header.Get("Authorization") == "" {
+		// presigned url
+		return ErrCannotResign
+	}
+	return sign(req, credentials, now)
+}
+
+// SignRequest signs request created by akubra itself, e.g. replayed write,
+// with AWS Signature Version 4 computed with credentials
+func SignRequest(req *http.Request, credentials Credentials) error {
+	return sign(req, credentials, time.Now())
+}
+
+func sign(req *http.Request, credentials Credentials, now time.Time) error {
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if strings.HasPrefix(payloadHash, streamingPayload) {
+		// chunk signatures are chained with request signature
+		return ErrCannotResign
+	}
+	service := credentials.Service
+	if service == "" {
+		service = "s3"
+	}
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+		if req.ContentLength == 0 {
+			payloadHash = emptyPayloadHash
+		}
+		if service == "s3" {
+			req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		}
+	}
+	if req.Host == "" {
+		req.Host = req.URL.Host
+	}
+	req.Header.Del("Authorization")
+	// token belongs to client credentials
+	req.Header.Del("X-Amz-Security-Token")
+	amzDate := now.UTC().Format(sigV4TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	names, canonicalHeaders := signedHeaders(req)
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// path is already escaped, only characters AWS escapes differently are fixed
+	unescapedPath, err := url.PathUnescape(path)
+	if err != nil {
+		return err
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(unescapedPath, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		strings.Join(names, ";"),
+		payloadHash,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := strings.Join([]string{date, credentials.Region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretKey), date)
+	key = hmacSHA256(key, credentials.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, credentials.AccessKey, scope, strings.Join(names, ";"), signature))
+	return nil
+}
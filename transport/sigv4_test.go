@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Credentials and time of AWS Signature Version 4 test suite
+var testSuiteCredentials = Credentials{
+	AccessKey: "AKIDEXAMPLE",
+	SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	Region:    "us-east-1",
+	Service:   "service",
+}
+
+var testSuiteTime = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+func TestSignV4MatchesTestSuite(t *testing.T) {
+	cases := []struct {
+		name      string
+		url       string
+		signature string
+	}{
+		{"get-vanilla", "https://example.amazonaws.com/",
+			"5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"get-vanilla-query-order-key-case", "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			"b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", c.url, nil)
+		req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=client")
+		if err := signV4(req, testSuiteCredentials, testSuiteTime); err != nil {
+			t.Fatalf("%s: unexpected error %s", c.name, err)
+		}
+		expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=" + c.signature
+		if auth := req.Header.Get("Authorization"); auth != expected {
+			t.Errorf("%s: expected Authorization %q, got %q", c.name, expected, auth)
+		}
+		if date := req.Header.Get("X-Amz-Date"); date != "20150830T123600Z" {
+			t.Errorf("%s: expected X-Amz-Date 20150830T123600Z, got %q", c.name, date)
+		}
+	}
+}
+
+func TestSignV4SetsS3PayloadHash(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "http://s3.internal/bucket/key", strings.NewReader("body"))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=client")
+	req.Header.Set("X-Amz-Security-Token", "client-token")
+	if err := signV4(req, Credentials{AccessKey: "a", SecretKey: "s", Region: "r"}, testSuiteTime); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if hash := req.Header.Get("X-Amz-Content-Sha256"); hash != unsignedPayload {
+		t.Errorf("expected %s payload hash, got %q", unsignedPayload, hash)
+	}
+	if token := req.Header.Get("X-Amz-Security-Token"); token != "" {
+		t.Errorf("client security token should be removed, got %q", token)
+	}
+	if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "/r/s3/aws4_request") ||
+		!strings.Contains(auth, "SignedHeaders=host;x-amz-content-sha256;x-amz-date") {
+		t.Errorf("unexpected Authorization %q", auth)
+	}
+}
+
+func TestSignV4RejectsUnresignableRequests(t *testing.T) {
+	presigned, _ := http.NewRequest("GET", "http://s3.internal/bucket/key?X-Amz-Signature=abc", nil)
+	streaming, _ := http.NewRequest("PUT", "http://s3.internal/bucket/key", strings.NewReader("body"))
+	streaming.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	streaming.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=client")
+	for _, req := range []*http.Request{presigned, streaming} {
+		if err := signV4(req, testSuiteCredentials, testSuiteTime); err != ErrCannotResign {
+			t.Errorf("expected ErrCannotResign for %s, got %v", req.URL, err)
+		}
+	}
+}
+
+func TestSignV4PassesAnonymousRequests(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://s3.internal/bucket/key", nil)
+	if err := signV4(req, testSuiteCredentials, testSuiteTime); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		t.Errorf("Anonymous request should not be signed, got %q", auth)
+	}
+}
+
+func TestBackendRequestsAreSignedWithBackendCredentials(t *testing.T) {
+	signed, _ := url.Parse("http://signed:8080")
+	passed, _ := url.Parse("http://passed:8080")
+	mt := &MultiTransport{Credentials: map[string]Credentials{"signed:8080": testSuiteCredentials}}
+	req, _ := http.NewRequest("GET", "http://akubra/bucket/key", nil)
+	req.Header.Set("Authorization", "client")
+
+	signedReq, err := mt.newBackendRequest(req, signed, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if auth := signedReq.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+		t.Errorf("expected request signed with backend credentials, got %q", auth)
+	}
+	passedReq, _ := mt.newBackendRequest(req, passed, nil)
+	if auth := passedReq.Header.Get("Authorization"); auth != "client" {
+		t.Errorf("expected client signature, got %q", auth)
+	}
+}
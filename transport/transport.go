@@ -1,14 +1,19 @@
 package transport
 
 import (
-	"bufio"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +30,27 @@ type ReqResErrTuple struct {
 	Failed bool
 }
 
+// copyBufferSize is size of buffers used to copy request bodies to backends
+const copyBufferSize = 32 * 1024
+
+// copyBufferPool keeps buffers used to copy request bodies so they are not
+// allocated per request
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// CopyBuffer copies src to dst like io.Copy, with buffer taken from pool.
+// Buffer is returned to pool once copying ended, so src must not use it
+// after Read returned
+func CopyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
 // Create io.Writer and num []io.ReadCloser where all writer writes will be
 // accessible by readers
 func multiplicateReadClosers(num int) (writer io.Writer, readers []io.ReadCloser) {
@@ -35,52 +61,114 @@ func multiplicateReadClosers(num int) (writer io.Writer, readers []io.ReadCloser
 		readers = append(readers, pr)
 		writers = append(writers, pw)
 	}
-	writer = io.MultiWriter(writers...)
+	writer = &multiWriter{writers}
 	return writer, readers
 }
 
+// multiWriter duplicates writes to all writers as io.MultiWriter does, but
+// failing writer (e.g. pipe closed by disconnected backend) is dropped, so
+// remaining writers keep receiving data. Write fails once all writers failed
+type multiWriter struct {
+	writers []io.Writer
+}
+
+func (mw *multiWriter) Write(p []byte) (n int, err error) {
+	active := mw.writers[:0]
+	for _, w := range mw.writers {
+		wn, werr := w.Write(p)
+		if werr == nil && wn < len(p) {
+			werr = io.ErrShortWrite
+		}
+		if werr != nil {
+			err = werr
+			continue
+		}
+		active = append(active, w)
+	}
+	mw.writers = active
+	if len(active) == 0 {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 // MultipleResponsesHandler should handle chan of incomming ReqResErrTuple
 // returned value's response and error will be passed to client
 type MultipleResponsesHandler func(in <-chan *ReqResErrTuple) *ReqResErrTuple
 
-func defaultHandleResponses(in <-chan *ReqResErrTuple, out chan<- *ReqResErrTuple) {
-	errs := []*ReqResErrTuple{}
+// StatusPreference lists status classes (e.g. 2 for 2xx) of responses in
+// order of preference. Responses of unlisted classes are less preferred,
+// among them one with lowest status is chosen. Transport errors are least
+// preferred
+type StatusPreference []int
+
+// DefaultStatusPreference prefers successful responses, then redirects
+var DefaultStatusPreference = StatusPreference{2, 3}
+
+// rank returns position of response in preference order, lower is better
+func (sp StatusPreference) rank(r *ReqResErrTuple) int {
+	if r.Err != nil || r.Res == nil {
+		return len(sp) + 1
+	}
+	for i, class := range sp {
+		if r.Res.StatusCode/100 == class {
+			return i
+		}
+	}
+	return len(sp)
+}
+
+// Prefers checks if response a is preferred over b
+func (sp StatusPreference) Prefers(a, b *ReqResErrTuple) bool {
+	aRank, bRank := sp.rank(a), sp.rank(b)
+	if aRank == len(sp) && bRank == len(sp) {
+		return a.Res.StatusCode < b.Res.StatusCode
+	}
+	return aRank < bRank
+}
+
+func (sp StatusPreference) handleResponses(in <-chan *ReqResErrTuple, out chan<- *ReqResErrTuple) {
+	var best *ReqResErrTuple
 	clearBody := []*ReqResErrTuple{}
 	respPassed := false
-	for {
-		r, ok := <-in
-		if !ok {
-			break
-		}
-		// discard body of successful responses if response already passed to client
+	for r := range in {
+		// discard body of responses if response already passed to client
 		if respPassed {
 			clearBody = append(clearBody, r)
+			continue
 		}
-		// pass first successful answer to client
-		if r.Err == nil && !respPassed {
+		// pass first response of most preferred class without waiting for others
+		if len(sp) > 0 && sp.rank(r) == 0 {
 			out <- r
 			respPassed = true
+			if best != nil {
+				clearBody = append(clearBody, best)
+			}
+			continue
 		}
-		// if error occured then append it into errs slice
-		if r.Err != nil {
-			if !respPassed {
-				errs = append(errs, r)
-			} else {
-				// we passed response so discard response bodies as soon as possible
-				clearBody = append(clearBody, r)
+		if best == nil || sp.Prefers(r, best) {
+			if best != nil {
+				clearBody = append(clearBody, best)
 			}
+			best = r
+			continue
 		}
+		clearBody = append(clearBody, r)
 	}
 
-	// if no response passed and has errors pass first one to client
-	if !respPassed && len(errs) > 0 {
-		out <- errs[0]
-		// pop first error
-		errs = errs[1:]
+	if !respPassed && best != nil {
+		out <- best
 	}
-	// close other error responses
-	clearResponsesBody(append(errs, clearBody...))
+	// close other responses
+	clearResponsesBody(clearBody)
+}
 
+// HandleResponses is MultipleResponsesHandler passing most preferred
+// response
+func (sp StatusPreference) HandleResponses(in <-chan *ReqResErrTuple) *ReqResErrTuple {
+	out := make(chan *ReqResErrTuple, 1)
+	go sp.handleResponses(in, out)
+	return <-out
 }
 
 func clearResponsesBody(respTups []*ReqResErrTuple) {
@@ -90,17 +178,16 @@ func clearResponsesBody(respTups []*ReqResErrTuple) {
 			if err != nil {
 				rtup.Err = err
 			}
+			_ = rtup.Res.Body.Close()
 		}
 	}
 }
 
 // DefaultHandleResponses is default way of handling multiple responses.
-// It will pass first success response or any error if no
-// success occured
+// It will pass first success response, then first redirect, then response
+// with lowest error status or any error if no response came in
 func DefaultHandleResponses(in <-chan *ReqResErrTuple) *ReqResErrTuple {
-	out := make(chan *ReqResErrTuple, 1)
-	go defaultHandleResponses(in, out)
-	return <-out
+	return DefaultStatusPreference.HandleResponses(in)
 }
 
 // ErrTimeout is returned if TimeoutReader exceeds timeout
@@ -110,35 +197,122 @@ var ErrTimeout = errors.New("Read timeout")
 // declared ContentLength header
 var ErrBodyContentLengthMismatch = errors.New("Body ContentLength miss match")
 
+// ContentLengthMismatchError is returned if request body ended before
+// declared ContentLength was read
+type ContentLengthMismatchError struct {
+	Declared int64
+	Read     int64
+}
+
+func (e *ContentLengthMismatchError) Error() string {
+	return fmt.Sprintf("%s: declared %d bytes, read %d", ErrBodyContentLengthMismatch, e.Declared, e.Read)
+}
+
+// ErrNoBackends is returned if there is no backend to send request to
+var ErrNoBackends = errors.New("No backends available")
+
+// ErrBackendSkipped is error of writes not sent to backend, because it was
+// ejected by HealthChecker or its circuit was open
+var ErrBackendSkipped = errors.New("Backend skipped as unavailable")
+
 // TimeoutReader returns error if cannot read any byte for Timeout duration
 type TimeoutReader struct {
 	// R is original reader
 	R io.Reader
 	// Timeout defines how long TimeoutReader will wait for next byte
 	Timeout time.Duration
+	// R reads into private buffer, as read may still be running after
+	// timeout, when caller already reuses its buffer. Buffer is taken from
+	// copyBufferPool and returned once R returned error
+	buf *[]byte
 }
 
 // Read implements io.Reader interface
 func (tr *TimeoutReader) Read(b []byte) (n int, err error) {
-	gotsome := make(chan bool)
+	return tr.read(nil, b)
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+// read waits for data until timeout passes or done channel is closed
+func (tr *TimeoutReader) read(done <-chan struct{}, b []byte) (int, error) {
+	if tr.buf == nil || len(*tr.buf) < len(b) {
+		tr.releaseBuffer()
+		if len(b) <= copyBufferSize {
+			tr.buf = copyBufferPool.Get().(*[]byte)
+		} else {
+			buf := make([]byte, len(b))
+			tr.buf = &buf
+		}
+	}
+	buf := (*tr.buf)[:len(b)]
+	gotsome := make(chan readResult, 1)
 	go func() {
-		n, err = tr.R.Read(b)
-		gotsome <- true
+		n, err := tr.R.Read(buf)
+		gotsome <- readResult{n, err}
 	}()
 
 	select {
 	case <-time.After(tr.Timeout):
+		// abandoned read may still write to buffer
+		tr.buf = nil
 		return 0, ErrTimeout
-	case <-gotsome:
-		return
+	case <-done:
+		tr.buf = nil
+		return 0, context.Canceled
+	case res := <-gotsome:
+		copy(b, buf[:res.n])
+		if res.err != nil {
+			tr.releaseBuffer()
+		}
+		return res.n, res.err
+	}
+}
+
+// releaseBuffer returns buffer to pool, it must not be used by running read
+func (tr *TimeoutReader) releaseBuffer() {
+	if tr.buf != nil && len(*tr.buf) == copyBufferSize {
+		copyBufferPool.Put(tr.buf)
+	}
+	tr.buf = nil
+}
+
+type contextTimeoutReader struct {
+	TimeoutReader
+	ctx context.Context
+}
+
+// Read implements io.Reader interface
+func (ctr *contextTimeoutReader) Read(b []byte) (int, error) {
+	n, err := ctr.read(ctr.ctx.Done(), b)
+	if err == context.Canceled {
+		err = ctr.ctx.Err()
+	}
+	return n, err
+}
+
+// NewTimeoutReader creates reader which returns ErrTimeout if it cannot read
+// any byte for timeout duration and context error once ctx is done. If ctx
+// has deadline later than timeout, reader waits for next byte till deadline
+func NewTimeoutReader(ctx context.Context, r io.Reader, timeout time.Duration) io.Reader {
+	if deadline, ok := ctx.Deadline(); ok {
+		if untilDeadline := deadline.Sub(time.Now()); untilDeadline > timeout {
+			timeout = untilDeadline
+		}
 	}
+	return &contextTimeoutReader{TimeoutReader{R: r, Timeout: timeout}, ctx}
 }
 
 // RequestProcessor helps change requests before roundtrip to backends
 // orig is request received from client, copies will be send further
 type RequestProcessor func(orig *http.Request, copies []*http.Request)
 
-// MultiTransport replicates request onto multiple backends
+// MultiTransport replicates request onto multiple backends. RoundTrip returns
+// as soon as HandleResponses picks response, requests to remaining backends
+// are completed in background, so slow backends receive whole writes
 type MultiTransport struct {
 	http.RoundTripper
 	// Backends is list of target endpoints URL
@@ -149,111 +323,473 @@ type MultiTransport struct {
 	// Remember to discard respose bodies if not read, otherwise
 	// Keep-Alives won't function properly
 	//
-	// If `HandleResponses` is nil will pass first successful
-	//(with status >= 200 & < 300) response or last failed.
+	// If `HandleResponses` is nil DefaultHandleResponses is used, passing
+	// response according to DefaultStatusPreference.
 	HandleResponses MultipleResponsesHandler
 	// Process request between replication and sending, useful for changing request headers
 	PreProcessRequest RequestProcessor
+	// If set requests are not sent to backends HealthChecker ejected
+	HealthChecker *HealthChecker
+	// If set requests are not sent to backends with open circuit
+	CircuitBreaker *CircuitBreaker
+	// If set requests failed due to transient errors are retried
+	RetryPolicy *RetryPolicy
+	// Read weights of backends keyed by host, backends not listed have
+	// weight 1. If set and ReplicatedMethods is nil, GET and HEAD requests
+	// are not replicated
+	Weights map[string]int
+	// Methods of requests replicated to all backends. Bodiless requests with
+	// other methods are sent to backends one at a time, in random order
+	// according to Weights, until one succeeds. If nil all requests are
+	// replicated
+	ReplicatedMethods map[string]bool
+	// Successful responses are checked by validators, response failing
+	// validation is treated as failed with validation error
+	ResponseValidators []ResponseValidator
+	// Host headers of backend requests keyed by backend host, backends not
+	// listed receive their own host
+	HostHeaders map[string]string
+	// Credentials keyed by backend host. Signed requests to listed backends
+	// are signed again with AWS Signature Version 4, client signature is not
+	// verified. Anonymous requests and requests to other backends are passed
+	// unchanged
+	Credentials map[string]Credentials
+	// If set limits number of in flight requests per backend
+	BackendLimiter *BackendLimiter
+	// If set MD5 of request body is computed, so ETags of responses can be
+	// verified with VerifyETag
+	VerifyETags bool
+	// If set MD5 of request body is compared with Content-MD5 header while
+	// body is streamed. On mismatch last bytes of body are not sent to
+	// backends and request fails with BadDigestError
+	VerifyContentMD5 bool
+	// If greater than 0 responses to writes (requests other than GET, HEAD
+	// and OPTIONS) are passed to HandleResponses once that many backends
+	// succeeded. If fewer succeeded all responses fail with QuorumError
+	WriteQuorum int
+	// writes replicated to backends, including ones completed in background
+	// after response was picked
+	writes sync.WaitGroup
+}
+
+// activeBackends returns backends which are not ejected by HealthChecker
+// nor have open circuit. If there is no such backend returns all of them
+func (mt *MultiTransport) activeBackends() []*url.URL {
+	if mt.HealthChecker == nil && mt.CircuitBreaker == nil {
+		return mt.Backends
+	}
+	active := make([]*url.URL, 0, len(mt.Backends))
+	for _, backend := range mt.Backends {
+		if mt.HealthChecker != nil && !mt.HealthChecker.Healthy(backend) {
+			continue
+		}
+		if mt.CircuitBreaker != nil && !mt.CircuitBreaker.available(backend) {
+			continue
+		}
+		active = append(active, backend)
+	}
+	if len(active) == 0 {
+		return mt.Backends
+	}
+	return active
+}
+
+// skippedWrites returns failed tuples for backends not included in active,
+// so writes they missed are logged in synclog
+func (mt *MultiTransport) skippedWrites(req *http.Request, active []*url.URL) []*ReqResErrTuple {
+	skipped := []*ReqResErrTuple{}
+	for _, backend := range mt.Backends {
+		if containsURL(active, backend) {
+			continue
+		}
+		r, err := mt.newBackendRequest(req, backend, nil)
+		if err != nil {
+			continue
+		}
+		skipped = append(skipped, &ReqResErrTuple{r, nil, ErrBackendSkipped, true})
+	}
+	return skipped
+}
+
+func containsURL(urls []*url.URL, u *url.URL) bool {
+	for _, item := range urls {
+		if item == u {
+			return true
+		}
+	}
+	return false
+}
+
+// weightedOrder returns backends in random order, backends with higher
+// weight are more likely to be placed earlier. Backends with weight 0 are
+// placed last
+func weightedOrder(backends []*url.URL, weights map[string]int) []*url.URL {
+	remaining := append([]*url.URL{}, backends...)
+	ordered := make([]*url.URL, 0, len(backends))
+	for len(remaining) > 0 {
+		total := 0
+		for _, backend := range remaining {
+			total += backendWeight(backend, weights)
+		}
+		picked := 0
+		if total > 0 {
+			point := rand.Intn(total)
+			for i, backend := range remaining {
+				point -= backendWeight(backend, weights)
+				if point < 0 {
+					picked = i
+					break
+				}
+			}
+		}
+		ordered = append(ordered, remaining[picked])
+		remaining = append(remaining[:picked], remaining[picked+1:]...)
+	}
+	return ordered
 }
 
-// ReplicateRequests creates request copies (one per MultiTransport.Bakcends item).
+func backendWeight(backend *url.URL, weights map[string]int) int {
+	weight, ok := weights[backend.Host]
+	if !ok {
+		return 1
+	}
+	if weight < 0 {
+		return 0
+	}
+	return weight
+}
+
+// isReplicated checks if request has to be sent to all backends
+func (mt *MultiTransport) isReplicated(req *http.Request) bool {
+	if req.ContentLength != 0 || len(req.TransferEncoding) > 0 {
+		return true
+	}
+	if mt.ReplicatedMethods != nil {
+		return mt.ReplicatedMethods[req.Method]
+	}
+	if mt.Weights != nil {
+		return req.Method != http.MethodGet && req.Method != http.MethodHead
+	}
+	return true
+}
+
+// newBackendRequest creates copy of req addressed to backend, with Host
+// header set to backend host or one from HostHeaders, signed with backend
+// Credentials if there are any
+func (mt *MultiTransport) newBackendRequest(req *http.Request, backend *url.URL, body io.ReadCloser) (*http.Request, error) {
+	req.URL.Host = backend.Host
+	r, err := http.NewRequest(req.Method, req.URL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = make([]string, len(v))
+		copy(r.Header[k], v)
+	}
+	r.ContentLength = req.ContentLength
+	r.TransferEncoding = req.TransferEncoding
+	if host, ok := mt.HostHeaders[backend.Host]; ok {
+		r.Host = host
+	}
+	if credentials, ok := mt.Credentials[backend.Host]; ok {
+		if err := signV4(r, credentials, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// ReplicateRequests creates request copies (one per healthy MultiTransport.Bakcends item).
 // New requests will have substituted Host field, original request body will be copied
-// simultaneously
+// simultaneously. Exactly ContentLength bytes of body are copied, excess bytes
+// are left unread, so http server treats them as next request on connection
 func (mt *MultiTransport) ReplicateRequests(req *http.Request, cancelFun context.CancelFunc) (reqs []*http.Request, err error) {
-	copiesCount := len(mt.Backends)
+	reqs, _, err = mt.replicateRequests(req, mt.activeBackends(), func(error) { cancelFun() })
+	return reqs, err
+}
+
+// replicateRequests works as ReplicateRequests for given backends,
+// onBodyError is called with reason of failed body copying
+func (mt *MultiTransport) replicateRequests(req *http.Request, backends []*url.URL, onBodyError func(error)) (
+	reqs []*http.Request, digest *bodyDigest, err error) {
+	copiesCount := len(backends)
 	reqs = make([]*http.Request, 0, copiesCount)
 	// We need some read closers
 	writer, readers := multiplicateReadClosers(copiesCount)
+	var hasher hash.Hash
+	if mt.VerifyETags && req.Body != nil && req.ContentLength > 0 {
+		hasher = md5.New()
+		writer = io.MultiWriter(writer, hasher)
+		digest = &bodyDigest{done: make(chan struct{})}
+	}
 
 	for i, reader := range readers {
-		req.URL.Host = mt.Backends[i].Host
-		body := io.LimitReader(reader, req.ContentLength)
-		r, rerr := http.NewRequest(req.Method, req.URL.String(), body)
-		// Copy request data
+		// closing body has to close pipe, so writes to it fail once
+		// transport gives up on request
+		body := struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(reader, req.ContentLength), reader}
+		r, rerr := mt.newBackendRequest(req, backends[i], body)
 		if rerr != nil {
-			return nil, rerr
-		}
-		r.Header = make(http.Header, len(req.Header))
-		for k, v := range req.Header {
-			r.Header[k] = make([]string, len(v))
-			copy(r.Header[k], v)
+			return nil, nil, rerr
 		}
-		r.ContentLength = req.ContentLength
-		r.TransferEncoding = req.TransferEncoding
 		reqs = append(reqs, r)
 	}
 	go func() {
 		// Copy original request body to replicated requests bodies
 		if req.Body != nil {
-			bodyReader := &TimeoutReader{
-				io.LimitReader(req.Body, req.ContentLength),
-				time.Second}
-			n, cerr := io.Copy(bufio.NewWriterSize(writer, int(req.ContentLength)), bodyReader)
+			var body io.Reader = io.LimitReader(req.Body, req.ContentLength)
+			if expected := req.Header.Get("Content-MD5"); mt.VerifyContentMD5 && expected != "" {
+				body = newDigestReader(body, req.ContentLength, expected)
+			}
+			bodyReader := NewTimeoutReader(req.Context(), body, time.Second)
+			n, cerr := CopyBuffer(writer, bodyReader)
 
-			if cerr != nil || n < req.ContentLength {
-				cancelFun()
+			switch {
+			case cerr == io.ErrUnexpectedEOF || cerr == nil && n < req.ContentLength:
+				onBodyError(&ContentLengthMismatchError{req.ContentLength, n})
+			case cerr != nil:
+				onBodyError(cerr)
+			case digest != nil:
+				digest.sum = hex.EncodeToString(hasher.Sum(nil))
+			}
+			if digest != nil {
+				close(digest.done)
 			}
 		}
 	}()
 
-	return reqs, err
+	return reqs, digest, err
 }
 
 func (mt *MultiTransport) sendRequest(
 	req *http.Request,
-	out chan *ReqResErrTuple) {
+	cancelErr func() error) *ReqResErrTuple {
 	ctx := req.Context()
-	o := make(chan *ReqResErrTuple)
+	// buffered, so goroutine finishes if result is no longer awaited
+	o := make(chan *ReqResErrTuple, 1)
 	go func() {
-		resp, err := mt.RoundTripper.RoundTrip(req)
+		probe := false
+		if mt.CircuitBreaker != nil {
+			var allowed bool
+			if allowed, probe = mt.CircuitBreaker.acquire(req.URL); !allowed {
+				o <- &ReqResErrTuple{req, nil, ErrCircuitOpen, true}
+				return
+			}
+		}
+		resp, err := mt.limitedRoundTrip(req)
 		// report Non 2XX status codes as errors
 		failed := err != nil || resp != nil && (resp.StatusCode < 200 || resp.StatusCode > 399)
+		if !failed {
+			err = mt.validate(req, resp)
+			failed = err != nil
+		}
+		if mt.CircuitBreaker != nil {
+			if ctx.Err() == nil && err != ErrBackendBusy {
+				// client errors don't indicate backend problems
+				mt.CircuitBreaker.Report(req.URL, err != nil || resp.StatusCode >= 500)
+			} else if probe {
+				mt.CircuitBreaker.release(req.URL)
+			}
+		}
 		r := &ReqResErrTuple{req, resp, err, failed}
 		o <- r
 	}()
 	var reqresperr *ReqResErrTuple
 	select {
 	case <-ctx.Done():
-		reqresperr = &ReqResErrTuple{req, nil, ErrBodyContentLengthMismatch, true}
+		reqresperr = &ReqResErrTuple{req, nil, cancelErr(), true}
+		go discardLate(o)
 	case reqresperr = <-o:
-		break
+		// request failed because it was canceled, report why
+		if reqresperr.Err != nil && ctx.Err() != nil {
+			reqresperr.Err = cancelErr()
+		}
+	}
+	return reqresperr
+}
+
+// discardLate closes body of response which came in after request was
+// abandoned
+func discardLate(o <-chan *ReqResErrTuple) {
+	if late := <-o; late.Res != nil && late.Res.Body != nil {
+		_ = late.Res.Body.Close()
 	}
-	out <- reqresperr
 }
 
-// RoundTrip satisfies http.RoundTripper interface
+type clientRequestKey struct{}
+
+// ClientRequest returns client request backend request was created from, or
+// nil if it's unknown
+func ClientRequest(backendReq *http.Request) *http.Request {
+	clientReq, _ := backendReq.Context().Value(clientRequestKey{}).(*http.Request)
+	return clientReq
+}
+
+// RoundTrip satisfies http.RoundTripper interface. Backend requests are
+// canceled if client cancels request before response is picked. Once
+// response is picked remaining backend requests are canceled for reads,
+// other requests are completed to keep backends in sync
 func (mt *MultiTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	bctx, cancelFunc := context.WithCancel(context.Background())
+	if !mt.isReplicated(req) {
+		return mt.roundTripOne(req)
+	}
+	bctx, cancelFunc := context.WithCancel(context.WithValue(context.Background(), clientRequestKey{}, req))
+	var bodyErr atomic.Value
+	cancelBody := func(err error) {
+		bodyErr.Store(&err)
+		cancelFunc()
+	}
+	cancelErr := func() error {
+		if err, ok := bodyErr.Load().(*error); ok {
+			return *err
+		}
+		return context.Canceled
+	}
 
-	reqs, err := mt.ReplicateRequests(req, cancelFunc)
+	backends := mt.activeBackends()
+	write := !isRead(req.Method)
+	skipped := []*ReqResErrTuple{}
+	if write {
+		skipped = mt.skippedWrites(req, backends)
+	}
+	reqs, digest, err := mt.replicateRequests(req, backends, cancelBody)
 	if err != nil {
+		cancelFunc()
 		return nil, err
 	}
+	bctx = withBodyDigest(bctx, digest)
 
-	c := make(chan *ReqResErrTuple, len(reqs))
+	c := make(chan *ReqResErrTuple, len(reqs)+len(skipped))
 	if len(reqs) == 0 {
-		return nil, errors.New("No requests provided")
+		cancelFunc()
+		return nil, ErrNoBackends
 	}
 
 	wg := sync.WaitGroup{}
+	cancels := make(map[*http.Request]context.CancelFunc, len(reqs))
 	for _, req := range reqs {
 		wg.Add(1)
-		r := req.WithContext(bctx)
+		rctx, rcancel := context.WithCancel(bctx)
+		r := req.WithContext(rctx)
+		cancels[r] = rcancel
 		go func() {
-			mt.sendRequest(r, c)
+			c <- mt.sendRequest(r, cancelErr)
 			wg.Done()
 		}()
 	}
 
+	if write {
+		mt.writes.Add(1)
+	}
 	// close c chanel once all requests comes in
 	go func() {
 		wg.Wait()
+		// skipped backends come last, so response of backend which was
+		// sent request is preferred
+		for _, r := range skipped {
+			c <- r
+		}
 		close(c)
+		if write {
+			mt.writes.Done()
+		}
+	}()
+
+	var in <-chan *ReqResErrTuple = c
+	if mt.WriteQuorum > 0 && write {
+		in = awaitQuorum(mt.WriteQuorum, in)
+	}
+	picked := propagateCancel(req.Context(), cancelFunc)
+	resTup := mt.HandleResponses(in)
+	close(picked)
+
+	if _, ok := cancels[resTup.Req]; ok && isRead(req.Method) {
+		for r, rcancel := range cancels {
+			if r != resTup.Req {
+				rcancel()
+			}
+		}
+	}
+	return resTup.Res, resTup.Err
+}
+
+// WaitForWrites waits until writes sent to backends, also ones completed in
+// background, are finished. Returns false if timeout passed first. It
+// should be called once no new requests are sent
+func (mt *MultiTransport) WaitForWrites(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		mt.writes.Wait()
+		close(done)
 	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// roundTripOne sends request to backends one by one until one succeeds.
+// Failed responses are passed to HandleResponses too, so they are logged and
+// their bodies discarded
+func (mt *MultiTransport) roundTripOne(req *http.Request) (*http.Response, error) {
+	ctx, cancelFunc := context.WithCancel(context.WithValue(context.Background(), clientRequestKey{}, req))
+	cancelErr := func() error {
+		return context.Canceled
+	}
+	backends := weightedOrder(mt.activeBackends(), mt.Weights)
+	if len(backends) == 0 {
+		cancelFunc()
+		return nil, ErrNoBackends
+	}
+
+	c := make(chan *ReqResErrTuple, len(backends))
+	go func() {
+		defer close(c)
+		for _, backend := range backends {
+			r, err := mt.newBackendRequest(req, backend, nil)
+			if err != nil {
+				c <- &ReqResErrTuple{req, nil, err, true}
+				return
+			}
+			tup := mt.sendRequest(r.WithContext(ctx), cancelErr)
+			c <- tup
+			if !tup.Failed || ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	picked := propagateCancel(req.Context(), cancelFunc)
 	resTup := mt.HandleResponses(c)
+	close(picked)
 	return resTup.Res, resTup.Err
 }
 
+// propagateCancel calls cancel once ctx is done, until returned channel is
+// closed
+func propagateCancel(ctx context.Context, cancel context.CancelFunc) chan<- struct{} {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+	return stop
+}
+
+func isRead(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
 // NewMultiTransport creates *MultiTransport. If requestsPreprocesor or responseHandler
 // are nil will use default ones
 func NewMultiTransport(roundTripper http.RoundTripper,
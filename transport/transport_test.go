@@ -2,10 +2,15 @@ package transport
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -159,20 +164,43 @@ func TestTimeoutReader(t *testing.T) {
 			<-time.After(100 * time.Millisecond)
 		}
 	}()
-	tr := &TimeoutReader{pr, time.Second * 2}
+	tr := &TimeoutReader{R: pr, Timeout: time.Second * 2}
 	for i := 0; i < 4; i++ {
 		_, err := tr.Read(make([]byte, 20))
 		if err != nil {
 			t.Errorf("Timeout was not reached, but error occured %s", err.Error())
 		}
 	}
-	tr2 := &TimeoutReader{pr, time.Millisecond}
+	tr2 := &TimeoutReader{R: pr, Timeout: time.Millisecond}
 	_, err := tr2.Read(make([]byte, 0, 20))
 	if err != ErrTimeout {
 		t.Errorf("Should return an err")
 	}
 }
 
+// lateReader fills buffer after delay
+type lateReader struct{ delay time.Duration }
+
+func (lr lateReader) Read(b []byte) (int, error) {
+	time.Sleep(lr.delay)
+	for i := range b {
+		b[i] = 'x'
+	}
+	return len(b), nil
+}
+
+func TestTimedOutReadDoesNotWriteCallerBuffer(t *testing.T) {
+	tr := &TimeoutReader{R: lateReader{20 * time.Millisecond}, Timeout: time.Millisecond}
+	buf := make([]byte, 8)
+	if _, err := tr.Read(buf); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !bytes.Equal(buf, make([]byte, 8)) {
+		t.Errorf("Abandoned read should not write to caller buffer, got %q", buf)
+	}
+}
+
 func TestRequestMultiplication(t *testing.T) {
 	stream := []byte("zażółć gęślą jaźń")
 	urls := mkDummySrvs(3, stream, t)
@@ -188,3 +216,762 @@ func TestRequestMultiplication(t *testing.T) {
 		t.Errorf("Should get ErrTimeout or ErrBodyContentLengthMismatch")
 	}
 }
+
+func BenchmarkReplicateRequests(b *testing.B) {
+	stream := bytes.Repeat([]byte("zażółć gęślą jaźń"), 4096)
+	urls := make([]*url.URL, 0, 3)
+	for i := 0; i < 3; i++ {
+		urls = append(urls, &url.URL{Scheme: "http", Host: "example.com"})
+	}
+	transp := &MultiTransport{Backends: urls}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := dummyReq(stream, 0)
+		reqs, err := transp.ReplicateRequests(req, func() {})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, r := range reqs {
+			go func(r *http.Request) {
+				_, cerr := io.Copy(ioutil.Discard, r.Body)
+				if cerr != nil {
+					b.Error(cerr)
+				}
+			}(r)
+		}
+	}
+}
+
+func BenchmarkTimeoutReader(b *testing.B) {
+	stream := bytes.Repeat([]byte("zażółć gęślą jaźń"), 4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr := NewTimeoutReader(context.Background(), bytes.NewReader(stream), time.Second)
+		// hides ReaderFrom, so body is read with pooled buffer like in replicateRequests
+		if _, err := CopyBuffer(struct{ io.Writer }{ioutil.Discard}, tr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSlowBackendWriteCompletesAfterResponse(t *testing.T) {
+	stream := []byte("zażółć gęślą jaźń")
+	completed := make(chan []byte, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.Copy(ioutil.Discard, r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		<-time.After(200 * time.Millisecond)
+		completed <- body
+	}))
+	defer slow.Close()
+	fastURL, _ := url.Parse(fast.URL)
+	slowURL, _ := url.Parse(slow.URL)
+	transp := NewMultiTransport(nil, []*url.URL{fastURL, slowURL}, nil)
+
+	start := time.Now()
+	resp, err := transp.RoundTrip(dummyReq(stream, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Request.URL.Host != fastURL.Host {
+		t.Error("Fast backend response should be returned")
+	}
+	if time.Since(start) >= 200*time.Millisecond {
+		t.Error("Response should not wait for slow backend")
+	}
+
+	select {
+	case body := <-completed:
+		if !bytes.Equal(stream, body) {
+			t.Errorf("Slow backend got partial body %q", body)
+		}
+	case <-time.After(time.Second):
+		t.Error("Slow backend write should complete")
+	}
+}
+
+func TestFailedReaderDoesNotAffectOthers(t *testing.T) {
+	forkCount := 3
+	stream := []byte("zażółć gęślą jaźń\r\n")
+	writer, readers := multiplicateReadClosers(forkCount)
+	// first backend disconnected before reading anything
+	err := readers[0].(*io.PipeReader).CloseWithError(io.ErrUnexpectedEOF)
+	if err != nil {
+		t.Error(err)
+	}
+	go func() {
+		_, werr := writer.Write(stream)
+		if werr != nil {
+			t.Errorf("Write should succeed while some readers are alive, got %s", werr)
+		}
+		_, werr = writer.Write(stream)
+		if werr != nil {
+			t.Errorf("Write should succeed while some readers are alive, got %s", werr)
+		}
+	}()
+	done := make(chan []byte, forkCount)
+	for _, reader := range readers[1:] {
+		go func(r io.Reader) {
+			p := make([]byte, 2*len(stream))
+			_, rerr := io.ReadFull(r, p)
+			if rerr != nil {
+				t.Error(rerr)
+			}
+			done <- p
+		}(reader)
+	}
+	for range readers[1:] {
+		select {
+		case p := <-done:
+			if !bytes.Equal(append(stream, stream...), p) {
+				t.Errorf("Expected same readings as writes got %q", p)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Reader starved after other reader failed")
+		}
+	}
+}
+
+func TestAllReadersFailed(t *testing.T) {
+	writer, readers := multiplicateReadClosers(2)
+	for _, r := range readers {
+		err := r.Close()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	_, err := writer.Write([]byte("data"))
+	if err != io.ErrClosedPipe {
+		t.Errorf("Expected io.ErrClosedPipe, got %v", err)
+	}
+}
+
+func TestChecksumHeadersAreReplicated(t *testing.T) {
+	checksum := "AAAAAA=="
+	received := make(chan string, 2)
+	urls := make([]*url.URL, 0, 2)
+	for i := 0; i < 2; i++ {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.Copy(ioutil.Discard, r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			received <- r.Header.Get("X-Amz-Checksum-Crc32")
+			w.Header().Set("X-Amz-Checksum-Crc32", r.Header.Get("X-Amz-Checksum-Crc32"))
+		}))
+		defer ts.Close()
+		u, _ := url.Parse(ts.URL)
+		urls = append(urls, u)
+	}
+	transp := NewMultiTransport(nil, urls, nil)
+	req := dummyReq([]byte("zażółć gęślą jaźń"), 0)
+	req.Header.Set("X-Amz-Checksum-Crc32", checksum)
+
+	resp, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("X-Amz-Checksum-Crc32") != checksum {
+		t.Error("Checksum header should be relayed to client")
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-received; got != checksum {
+			t.Errorf("Backend got checksum %q, expected %q", got, checksum)
+		}
+	}
+}
+
+func TestTimeoutReaderWithContext(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer func() {
+		if err := pw.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := NewTimeoutReader(ctx, pr, time.Second)
+	go func() {
+		<-time.After(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := tr.Read(make([]byte, 20))
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if time.Since(start) >= time.Second {
+		t.Error("Read should return once context is canceled")
+	}
+
+	tr = NewTimeoutReader(context.Background(), pr, 10*time.Millisecond)
+	_, err = tr.Read(make([]byte, 20))
+	if err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout on idle reader, got %v", err)
+	}
+
+	deadlineCtx, deadlineCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer deadlineCancel()
+	dpr, dpw := io.Pipe()
+	tr = NewTimeoutReader(deadlineCtx, dpr, time.Millisecond)
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		_, werr := dpw.Write([]byte("data"))
+		if werr != nil {
+			t.Error(werr)
+		}
+	}()
+	n, err := tr.Read(make([]byte, 20))
+	if err != nil || n != 4 {
+		t.Errorf("Reader should wait for data till context deadline, got %d, %v", n, err)
+	}
+}
+
+func mkCancelObservingServer(observed chan<- string, name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			observed <- name
+		case <-time.After(2 * time.Second):
+		}
+	}))
+}
+
+func TestClientCancellationIsPropagatedToBackends(t *testing.T) {
+	observed := make(chan string, 2)
+	first := mkCancelObservingServer(observed, "first")
+	defer first.Close()
+	second := mkCancelObservingServer(observed, "second")
+	defer second.Close()
+	firstURL, _ := url.Parse(first.URL)
+	secondURL, _ := url.Parse(second.URL)
+	transp := NewMultiTransport(nil, []*url.URL{firstURL, secondURL}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/object", nil)
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err := transp.RoundTrip(req.WithContext(ctx))
+	if err == nil {
+		t.Error("Canceled request should fail")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-observed:
+		case <-time.After(time.Second):
+			t.Fatal("Backends should observe client cancellation")
+		}
+	}
+}
+
+func TestSiblingReadsAreCanceledOnceResponseIsPicked(t *testing.T) {
+	observed := make(chan string, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	slow := mkCancelObservingServer(observed, "slow")
+	defer slow.Close()
+	fastURL, _ := url.Parse(fast.URL)
+	slowURL, _ := url.Parse(slow.URL)
+	transp := NewMultiTransport(nil, []*url.URL{fastURL, slowURL}, nil)
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/object", nil)
+	resp, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Request.URL.Host != fastURL.Host {
+		t.Error("Fast backend response should be returned")
+	}
+	select {
+	case <-observed:
+	case <-time.After(time.Second):
+		t.Error("Slow backend should observe cancellation")
+	}
+}
+
+func TestWeightedOrderHonorsWeights(t *testing.T) {
+	light, _ := url.Parse("http://light:8080")
+	heavy, _ := url.Parse("http://heavy:8080")
+	disabled, _ := url.Parse("http://disabled:8080")
+	backends := []*url.URL{light, heavy, disabled}
+	weights := map[string]int{"heavy:8080": 3, "disabled:8080": 0}
+
+	firsts := make(map[string]int)
+	iterations := 4000
+	for i := 0; i < iterations; i++ {
+		ordered := weightedOrder(backends, weights)
+		if len(ordered) != len(backends) {
+			t.Fatalf("Expected %d backends, got %d", len(backends), len(ordered))
+		}
+		if ordered[2] != disabled {
+			t.Fatal("Backend with weight 0 should be placed last")
+		}
+		firsts[ordered[0].Host]++
+	}
+	heavyShare := float64(firsts["heavy:8080"]) / float64(iterations)
+	if heavyShare < 0.7 || heavyShare > 0.8 {
+		t.Errorf("Heavy backend should be picked first in ~75%% cases, got %.2f", heavyShare)
+	}
+}
+
+func TestWeightedReadsHitSingleBackendWritesHitAll(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.Method]++
+		mu.Unlock()
+		_, err := io.Copy(ioutil.Discard, r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+	firstURL, _ := url.Parse(first.URL)
+	secondURL, _ := url.Parse(second.URL)
+	transp := NewMultiTransport(nil, []*url.URL{firstURL, secondURL}, nil)
+	transp.Weights = map[string]int{firstURL.Host: 1, secondURL.Host: 1}
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/object", nil)
+	resp, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = resp.Body.Close(); err != nil {
+		t.Error(err)
+	}
+	resp, err = transp.RoundTrip(dummyReq([]byte("content"), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = resp.Body.Close(); err != nil {
+		t.Error(err)
+	}
+	<-time.After(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if hits["GET"] != 1 {
+		t.Errorf("Read should hit single backend, got %d", hits["GET"])
+	}
+	if hits["POST"] != 2 {
+		t.Errorf("Write should hit all backends, got %d", hits["POST"])
+	}
+}
+
+type trackingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (tb *trackingBody) Close() error {
+	tb.closed = true
+	return nil
+}
+
+// hostRoundTripper responds with status configured for request host
+type hostRoundTripper struct {
+	mu       sync.Mutex
+	statuses map[string]int
+	hosts    []string
+	bodies   []*trackingBody
+}
+
+func (hrt *hostRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	hrt.mu.Lock()
+	defer hrt.mu.Unlock()
+	hrt.hosts = append(hrt.hosts, req.URL.Host)
+	body := &trackingBody{Reader: bytes.NewBufferString("body")}
+	hrt.bodies = append(hrt.bodies, body)
+	return &http.Response{
+		StatusCode: hrt.statuses[req.URL.Host],
+		Header:     make(http.Header),
+		Body:       body,
+		Request:    req,
+	}, nil
+}
+
+func TestReadOneFailsOverToNextBackend(t *testing.T) {
+	failing, _ := url.Parse("http://failing:8080")
+	healthy, _ := url.Parse("http://healthy:8080")
+	rt := &hostRoundTripper{statuses: map[string]int{
+		"failing:8080": http.StatusInternalServerError,
+		"healthy:8080": http.StatusOK,
+	}}
+	transp := NewMultiTransport(rt, []*url.URL{failing, healthy}, func(in <-chan *ReqResErrTuple) *ReqResErrTuple {
+		var last *ReqResErrTuple
+		for tup := range in {
+			if last != nil {
+				if err := last.Res.Body.Close(); err != nil {
+					t.Error(err)
+				}
+			}
+			last = tup
+		}
+		return last
+	})
+	// failing backend is always tried first
+	transp.Weights = map[string]int{"healthy:8080": 0}
+	transp.ReplicatedMethods = map[string]bool{"PUT": true}
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/object", nil)
+	resp, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected response of healthy backend, got %d", resp.StatusCode)
+	}
+	if len(rt.hosts) != 2 || rt.hosts[0] != "failing:8080" {
+		t.Errorf("Expected failing backend tried before healthy one, got %v", rt.hosts)
+	}
+	if !rt.bodies[0].closed {
+		t.Error("Body of failed response should be closed")
+	}
+}
+
+func TestReplicatedMethods(t *testing.T) {
+	first, _ := url.Parse("http://first:8080")
+	second, _ := url.Parse("http://second:8080")
+	rt := &hostRoundTripper{statuses: map[string]int{
+		"first:8080":  http.StatusOK,
+		"second:8080": http.StatusOK,
+	}}
+	transp := NewMultiTransport(rt, []*url.URL{first, second}, nil)
+	transp.ReplicatedMethods = map[string]bool{"PUT": true}
+
+	req, _ := http.NewRequest("DELETE", "http://example.com/bucket/object", nil)
+	_, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.mu.Lock()
+	if len(rt.hosts) != 1 {
+		t.Errorf("Not replicated request should be sent to single backend, got %v", rt.hosts)
+	}
+	rt.hosts = nil
+	rt.mu.Unlock()
+
+	req, _ = http.NewRequest("PUT", "http://example.com/bucket/object", nil)
+	_, err = transp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(50 * time.Millisecond)
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if len(rt.hosts) != 2 {
+		t.Errorf("Replicated request should be sent to all backends, got %v", rt.hosts)
+	}
+}
+
+func TestBodyLongerThanContentLengthIsTruncated(t *testing.T) {
+	stream := []byte("zażółć gęślą jaźń")
+	declared := int64(5)
+	received := make(chan []byte, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- body
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+	firstURL, _ := url.Parse(first.URL)
+	secondURL, _ := url.Parse(second.URL)
+	transp := NewMultiTransport(nil, []*url.URL{firstURL, secondURL}, nil)
+
+	req := dummyReq(stream, declared-int64(len(stream)))
+	body := req.Body
+	_, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-received:
+			if !bytes.Equal(stream[:declared], got) {
+				t.Errorf("Expected %q, backend got %q", stream[:declared], got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Backend should receive request")
+		}
+	}
+	rest, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(stream[declared:], rest) {
+		t.Errorf("Excess bytes should be left unread, got %q", rest)
+	}
+}
+
+func TestBypassGovernanceHeaderReachesAllBackends(t *testing.T) {
+	received := make(chan string, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Amz-Bypass-Governance-Retention")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+	firstURL, _ := url.Parse(first.URL)
+	secondURL, _ := url.Parse(second.URL)
+	transp := NewMultiTransport(nil, []*url.URL{firstURL, secondURL}, nil)
+
+	req, _ := http.NewRequest("DELETE", "http://example.com/bucket/object", nil)
+	req.Header.Set("X-Amz-Bypass-Governance-Retention", "true")
+	_, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case value := <-received:
+			if value != "true" {
+				t.Errorf("Backend should receive bypass governance header, got %q", value)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("DELETE should reach all backends")
+		}
+	}
+}
+
+func TestTaggingReachesAllBackends(t *testing.T) {
+	received := make(chan *http.Request, 4)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Error(err)
+		}
+		received <- r
+		w.WriteHeader(http.StatusOK)
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+	firstURL, _ := url.Parse(first.URL)
+	secondURL, _ := url.Parse(second.URL)
+	transp := NewMultiTransport(nil, []*url.URL{firstURL, secondURL}, nil)
+
+	// Weights make bodiless requests sent to one backend only, tagging
+	// requests have body so they have to be replicated anyway
+	transp.Weights = map[string]int{firstURL.Host: 1, secondURL.Host: 1}
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("content"))
+	req.Header.Set("X-Amz-Tagging", "project=akubra&env=test")
+	if _, err := transp.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	tagging := "<Tagging><TagSet><Tag><Key>env</Key><Value>test</Value></Tag></TagSet></Tagging>"
+	req, _ = http.NewRequest("PUT", "http://example.com/bucket/object?tagging", bytes.NewBufferString(tagging))
+	if _, err := transp.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := map[string]int{}
+	for i := 0; i < 4; i++ {
+		select {
+		case r := <-received:
+			hosts[r.Host]++
+			_, isTaggingRequest := r.URL.Query()["tagging"]
+			if !isTaggingRequest && r.Header.Get("X-Amz-Tagging") != "project=akubra&env=test" {
+				t.Errorf("Backend should receive tagging header, got %q", r.Header.Get("X-Amz-Tagging"))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Tagged PUT should reach all backends")
+		}
+	}
+	if hosts[firstURL.Host] != 2 || hosts[secondURL.Host] != 2 {
+		t.Errorf("Each backend should receive both requests, got %v", hosts)
+	}
+}
+
+func mkStatusTuples(statuses ...int) <-chan *ReqResErrTuple {
+	in := make(chan *ReqResErrTuple, len(statuses))
+	for _, status := range statuses {
+		req, _ := http.NewRequest("GET", "http://backend:8080/bucket/object", nil)
+		if status == 0 {
+			in <- &ReqResErrTuple{Req: req, Err: errors.New("connection refused"), Failed: true}
+			continue
+		}
+		in <- &ReqResErrTuple{
+			Req:    req,
+			Res:    &http.Response{StatusCode: status, Body: ioutil.NopCloser(bytes.NewBufferString("body"))},
+			Failed: status > 399,
+		}
+	}
+	close(in)
+	return in
+}
+
+func TestDefaultHandleResponsesPrefersSuccess(t *testing.T) {
+	// 0 stands for transport error
+	for _, testCase := range []struct {
+		statuses []int
+		expected int
+	}{
+		{[]int{404, 200, 500}, 200},
+		{[]int{500, 404, 200}, 200},
+		{[]int{0, 200}, 200},
+		{[]int{404, 304, 200}, 200},
+		{[]int{404, 304, 500}, 304},
+		{[]int{500, 404, 503}, 404},
+		{[]int{0, 503}, 503},
+	} {
+		resTup := DefaultHandleResponses(mkStatusTuples(testCase.statuses...))
+		if resTup.Res == nil || resTup.Res.StatusCode != testCase.expected {
+			t.Errorf("Expected %d to be chosen from %v, got %+v", testCase.expected, testCase.statuses, resTup)
+		}
+	}
+	if resTup := DefaultHandleResponses(mkStatusTuples(0, 0)); resTup.Err == nil {
+		t.Error("Error should be passed if all requests failed")
+	}
+}
+
+func TestCustomStatusPreference(t *testing.T) {
+	// prefer not found over server errors and successes
+	preference := StatusPreference{4, 2}
+	resTup := preference.HandleResponses(mkStatusTuples(200, 500, 404))
+	if resTup.Res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 to be chosen, got %d", resTup.Res.StatusCode)
+	}
+}
+
+func TestEncryptionHeadersReachAllBackends(t *testing.T) {
+	received := make(chan http.Header, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Error(err)
+		}
+		received <- r.Header
+		w.Header().Set("X-Amz-Server-Side-Encryption", "aws:kms")
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+	firstURL, _ := url.Parse(first.URL)
+	secondURL, _ := url.Parse(second.URL)
+	transp := NewMultiTransport(nil, []*url.URL{firstURL, secondURL}, nil)
+
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/object", bytes.NewBufferString("content"))
+	req.Header.Set("X-Amz-Server-Side-Encryption", "aws:kms")
+	req.Header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", "alias/akubra")
+	resp, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("X-Amz-Server-Side-Encryption") != "aws:kms" {
+		t.Error("Response encryption header should be relayed")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case header := <-received:
+			if header.Get("X-Amz-Server-Side-Encryption") != "aws:kms" ||
+				header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != "alias/akubra" {
+				t.Errorf("Backend should receive encryption headers, got %v", header)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("PUT should reach all backends")
+		}
+	}
+}
+
+func TestEachBackendReceivesOwnHost(t *testing.T) {
+	received := make(chan string, 3)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Error(err)
+		}
+		received <- r.Host + r.URL.RequestURI()
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+	balanced := httptest.NewServer(handler)
+	defer balanced.Close()
+	firstURL, _ := url.Parse(first.URL)
+	secondURL, _ := url.Parse(second.URL)
+	balancedURL, _ := url.Parse(balanced.URL)
+	transp := NewMultiTransport(nil, []*url.URL{firstURL, secondURL, balancedURL}, nil)
+	transp.HostHeaders = map[string]string{balancedURL.Host: "s3.dc1.internal"}
+
+	req, _ := http.NewRequest("PUT", "http://bucket.akubra.internal/object?acl", bytes.NewBufferString("content"))
+	if _, err := transp.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	hosts := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		select {
+		case host := <-received:
+			hosts[host] = true
+		case <-time.After(time.Second):
+			t.Fatal("PUT should reach all backends")
+		}
+	}
+	for _, expected := range []string{firstURL.Host, secondURL.Host, "s3.dc1.internal"} {
+		if !hosts[expected+"/object?acl"] {
+			t.Errorf("Expected request with host %s, got %v", expected, hosts)
+		}
+	}
+}
+
+func TestCanceledReadsDoNotLeakGoroutines(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(50 * time.Millisecond):
+		}
+	}))
+	defer slow.Close()
+	fastURL, _ := url.Parse(fast.URL)
+	slowURL, _ := url.Parse(slow.URL)
+	rt := &http.Transport{}
+	transp := NewMultiTransport(rt, []*url.URL{fastURL, slowURL}, nil)
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/bucket/object", nil)
+		resp, err := transp.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Unexpected error %s", err)
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rt.CloseIdleConnections()
+		leaked := runtime.NumGoroutine() - before
+		if leaked <= 5 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines leaked", leaked)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
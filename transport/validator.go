@@ -0,0 +1,44 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ResponseValidator checks successful backend response, returned error
+// makes response treated as failed
+type ResponseValidator func(req *http.Request, resp *http.Response) error
+
+// ValidationError is returned for successful backend responses which failed
+// validation
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+// RequiredHeaders creates ResponseValidator which fails responses lacking
+// any of headers required for request method
+func RequiredHeaders(headers map[string][]string) ResponseValidator {
+	return func(req *http.Request, resp *http.Response) error {
+		for _, name := range headers[req.Method] {
+			if resp.Header.Get(name) == "" {
+				return fmt.Errorf("backend response to %s lacks %s header", req.Method, name)
+			}
+		}
+		return nil
+	}
+}
+
+// validate runs validators on successful response, failure is returned as
+// ValidationError
+func (mt *MultiTransport) validate(req *http.Request, resp *http.Response) error {
+	for _, validator := range mt.ResponseValidators {
+		if err := validator(req, resp); err != nil {
+			return &ValidationError{err}
+		}
+	}
+	return nil
+}
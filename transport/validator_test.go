@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestResponseLackingRequiredHeaderIsFailed(t *testing.T) {
+	withETag, _ := url.Parse("http://with-etag:8080")
+	withoutETag, _ := url.Parse("http://without-etag:8080")
+	rt := &hostRoundTripper{statuses: map[string]int{
+		"with-etag:8080":    http.StatusOK,
+		"without-etag:8080": http.StatusOK,
+	}}
+	etagged := headersRoundTripper{rt, map[string]string{"with-etag:8080": "ETag"}}
+	tuples := make(chan *ReqResErrTuple, 2)
+	transp := NewMultiTransport(etagged, []*url.URL{withETag, withoutETag}, func(in <-chan *ReqResErrTuple) *ReqResErrTuple {
+		var passed *ReqResErrTuple
+		for tup := range in {
+			tuples <- tup
+			if !tup.Failed {
+				passed = tup
+			}
+		}
+		close(tuples)
+		return passed
+	})
+	transp.ResponseValidators = []ResponseValidator{RequiredHeaders(map[string][]string{"PUT": {"ETag"}})}
+
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/object", nil)
+	resp, err := transp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Request.URL.Host != "with-etag:8080" {
+		t.Errorf("Response with required header should be passed, got %s", resp.Request.URL.Host)
+	}
+	for tup := range tuples {
+		if tup.Req.URL.Host == "without-etag:8080" && (!tup.Failed || tup.Err == nil) {
+			t.Error("Response lacking required header should be failed with validation error")
+		}
+	}
+}
+
+// headersRoundTripper sets header on responses of given hosts
+type headersRoundTripper struct {
+	roundTripper http.RoundTripper
+	headers      map[string]string
+}
+
+func (hrt headersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := hrt.roundTripper.RoundTrip(req)
+	if name, ok := hrt.headers[req.URL.Host]; ok && err == nil {
+		resp.Header.Set(name, "value")
+	}
+	return resp, err
+}
+
+func TestVerifyETag(t *testing.T) {
+	digest := &bodyDigest{done: make(chan struct{}), sum: "9a0364b9e99bb480dd25e1f0284c8555"}
+	close(digest.done)
+	req, _ := http.NewRequest("PUT", "http://backend:8080/bucket/object", nil)
+	req = req.WithContext(withBodyDigest(req.Context(), digest))
+	for etag, valid := range map[string]bool{
+		`"9a0364b9e99bb480dd25e1f0284c8555"`:   true,
+		`"9A0364B9E99BB480DD25E1F0284C8555"`:   true,
+		`"d41d8cd98f00b204e9800998ecf8427e"`:   false,
+		`"d41d8cd98f00b204e9800998ecf8427e-2"`: true,
+		"":                                     true,
+	} {
+		resp := &http.Response{Header: http.Header{"Etag": {etag}}}
+		if err := VerifyETag(req, resp); (err == nil) != valid {
+			t.Errorf("ETag %s verification result: %v", etag, err)
+		}
+	}
+	for _, header := range []http.Header{
+		{"X-Amz-Server-Side-Encryption": {"aws:kms"}},
+		{"X-Amz-Server-Side-Encryption-Customer-Algorithm": {"AES256"}},
+	} {
+		header.Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		if err := VerifyETag(req, &http.Response{Header: header}); err != nil {
+			t.Errorf("ETag of encrypted object should not be verified, got %s", err)
+		}
+	}
+}